@@ -12,10 +12,12 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/docker/go-units"
+	"github.com/prometheus/common/model"
 	"github.com/sirupsen/logrus"
 	api "k8s.io/api/core/v1"
 
@@ -90,13 +92,224 @@ type DockerConfig struct {
 	HelperImage                string            `toml:"helper_image,omitempty" json:"helper_image" long:"helper-image" env:"DOCKER_HELPER_IMAGE" description:"[ADVANCED] Override the default helper image used to clone repos and upload artifacts"`
 }
 
+// DockerMachineFlavor describes an additional machine variant with its
+// own idle targets, so that e.g. expensive GPU hosts can keep zero idle
+// machines while cheap CPU hosts keep several
+type DockerMachineFlavor struct {
+	Name           string   `toml:"Name" description:"Name of the machine flavor"`
+	MachineOptions []string `toml:"MachineOptions,omitempty" description:"Additional machine creation options for this flavor"`
+	IdleCount      int      `toml:"IdleCount,omitzero" description:"Maximum idle machines of this flavor"`
+	IdleTime       int      `toml:"IdleTime,omitzero" description:"Minimum time after a machine of this flavor can be destroyed"`
+	// Limit caps the total machines of this flavor on top of the global
+	// limits, so a scarce flavor can be held at a handful of machines
+	// while the shared pool scales much further
+	Limit int `toml:"Limit,omitzero" description:"Maximum total machines of this flavor (0 means unlimited)"`
+	// FlavorFallback lists the flavors to try, in order, when this one is
+	// at its limit or fails to create, e.g. falling back from spot to
+	// on-demand instances
+	FlavorFallback []string `toml:"FlavorFallback,omitempty" description:"Flavors to fall back to when this one cannot produce a machine"`
+	// Weight is how much of the MaxWeight capacity cap one machine of
+	// this flavor consumes, e.g. its vCPU count; zero counts as 1
+	Weight int `toml:"Weight,omitzero" description:"Capacity weight of one machine of this flavor (default 1)"`
+}
+
 type DockerMachine struct {
-	IdleCount      int      `long:"idle-nodes" env:"MACHINE_IDLE_COUNT" description:"Maximum idle machines"`
-	IdleTime       int      `toml:"IdleTime,omitzero" long:"idle-time" env:"MACHINE_IDLE_TIME" description:"Minimum time after node can be destroyed"`
-	MaxBuilds      int      `toml:"MaxBuilds,omitzero" long:"max-builds" env:"MACHINE_MAX_BUILDS" description:"Maximum number of builds processed by machine"`
-	MachineDriver  string   `long:"machine-driver" env:"MACHINE_DRIVER" description:"The driver to use when creating machine"`
-	MachineName    string   `long:"machine-name" env:"MACHINE_NAME" description:"The template for machine name (needs to include %s)"`
-	MachineOptions []string `long:"machine-options" env:"MACHINE_OPTIONS" description:"Additional machine creation options"`
+	// Mode spells out the scaling intent that is otherwise inferred from
+	// IdleCount: "pre-create" keeps a warm pool of IdleCount machines,
+	// "on-demand" only creates a machine when a job asks for one
+	Mode      string `long:"machine-mode" env:"MACHINE_MODE" description:"Scaling mode: pre-create or on-demand (inferred from IdleCount when empty)"`
+	IdleCount int    `long:"idle-nodes" env:"MACHINE_IDLE_COUNT" description:"Maximum idle machines"`
+	// MinIdleCount is a hard floor that the removal sweep respects even
+	// when IdleCount or the off-peak schedule aims for zero, so the next
+	// job never has to wait for a cold create. Draining the pool for
+	// shutdown ignores the floor
+	MinIdleCount int `long:"min-idle-nodes" env:"MACHINE_MIN_IDLE_COUNT" description:"Minimum number of idle machines that are never removed"`
+	// IdlePercentOfPeak sizes the idle pool as a percentage of the peak
+	// concurrent build count seen in the rolling demand window, so the
+	// warm pool right-sizes itself; MinIdleCount is its floor and
+	// IdleCountMax its ceiling
+	IdlePercentOfPeak int `long:"idle-percent-of-peak" env:"MACHINE_IDLE_PERCENT_OF_PEAK" description:"Idle machines target as a percentage of the recent peak concurrent builds (0 = use IdleCount)"`
+	// IdleCountMax caps the percent-of-peak idle target
+	IdleCountMax int `long:"idle-count-max" env:"MACHINE_IDLE_COUNT_MAX" description:"Upper bound for the percent-of-peak idle target (0 = unbounded)"`
+	StandbyCount int `long:"standby-nodes" env:"MACHINE_STANDBY_COUNT" description:"Number of warm standby machines kept outside the acquire pool"`
+	IdleTime     int `toml:"IdleTime,omitzero" long:"idle-time" env:"MACHINE_IDLE_TIME" description:"Minimum time after node can be destroyed"`
+
+	// RemovalStrategy picks which idle machine the downscaling sweep
+	// removes first: "oldest-first" rotates the fleet, "youngest-first"
+	// preserves warm caches and "most-used-first" retires the machines
+	// closest to their build limit. Empty keeps the backend list order
+	RemovalStrategy string `long:"machine-removal-strategy" env:"MACHINE_REMOVAL_STRATEGY" description:"Which idle machine to remove first when downscaling: oldest-first, youngest-first or most-used-first"`
+
+	// StopOnDownscale parks over-target idle machines in the stopped
+	// state instead of removing them: on clouds where stopped instances
+	// cost next to nothing, restarting one beats a fresh create
+	StopOnDownscale bool `long:"machine-stop-on-downscale" env:"MACHINE_STOP_ON_DOWNSCALE" description:"Stop over-target idle machines instead of removing them and restart them on demand"`
+
+	MaxBuilds int `toml:"MaxBuilds,omitzero" long:"max-builds" env:"MACHINE_MAX_BUILDS" description:"Maximum number of builds processed by machine"`
+
+	// CountBuildsAt decides when a build counts against MaxBuilds:
+	// "start" (the default) counts it the moment the machine is handed
+	// out, "finish" only once the build has run to completion, so a
+	// machine is never rotated for builds it did not actually finish
+	CountBuildsAt string `long:"machine-count-builds-at" env:"MACHINE_COUNT_BUILDS_AT" description:"When a build counts against MaxBuilds: start (default) or finish"`
+
+	// MaxMachineUseTime rotates a machine once its cumulative time spent
+	// running builds exceeds the given number of seconds, regardless of
+	// how few builds that took
+	MaxMachineUseTime int `long:"max-machine-use-time" env:"MACHINE_MAX_USE_TIME" description:"Maximum cumulative time in seconds a machine is allowed to run builds before it is rotated"`
+
+	// MaxBuildFailures removes a machine after this many consecutive
+	// failed builds, which usually points at a corrupted host (full
+	// disk, bad cache) rather than at the builds themselves; a single
+	// successful build resets the streak
+	MaxBuildFailures int      `long:"machine-max-build-failures" env:"MACHINE_MAX_BUILD_FAILURES" description:"Remove a machine after this many consecutive failed builds (0 = disabled)"`
+	MachineDriver    string   `long:"machine-driver" env:"MACHINE_DRIVER" description:"The driver to use when creating machine"`
+	MachineName      string   `long:"machine-name" env:"MACHINE_NAME" description:"The template for machine name (needs to include %s)"`
+	MachineOptions   []string `long:"machine-options" env:"MACHINE_OPTIONS" description:"Additional machine creation options"`
+
+	// NameSuffixLength overrides how many random characters the %s
+	// placeholder of MachineName expands to; the default suffix embeds
+	// the creation timestamp and is 19 characters long
+	NameSuffixLength int `long:"machine-name-suffix-length" env:"MACHINE_NAME_SUFFIX_LENGTH" description:"Length of the random machine name suffix (0 = the timestamp-based default)"`
+
+	// NameAlphanumericOnly restricts the generated suffix to lowercase
+	// letters and digits, for clouds that reject any other characters
+	// in instance names
+	NameAlphanumericOnly bool `long:"machine-name-alphanumeric-only" env:"MACHINE_NAME_ALPHANUMERIC_ONLY" description:"Use only lowercase letters and digits in generated machine names"`
+
+	// MaxNameLength rejects a configuration whose generated names could
+	// exceed the given number of characters, before the cloud does
+	MaxNameLength int `long:"machine-max-name-length" env:"MACHINE_MAX_NAME_LENGTH" description:"Maximum length a generated machine name may reach (0 = unchecked)"`
+
+	// UserData is a cloud-init startup script handed to the driver's
+	// user-data option at machine creation: either the path of a script
+	// file or the inline script itself, told apart by inline content
+	// containing a newline
+	UserData string `long:"machine-user-data" env:"MACHINE_USER_DATA" description:"Cloud-init user-data for new machines: a script file path or the inline script"`
+
+	// OverridableOptions lists the machine creation options that jobs may
+	// override through MACHINE_OPTION_* job variables; each override
+	// produces a distinct machine shape that is never shared with jobs
+	// expecting the default one
+	OverridableOptions []string `long:"machine-overridable-options" env:"MACHINE_OVERRIDABLE_OPTIONS" description:"Machine creation options that jobs are allowed to override via job variables"`
+
+	// MachineShape is derived at runtime from the job overrides; it is
+	// never read from the configuration file
+	MachineShape string `toml:"-"`
+
+	// MachineFlavors are scaled towards their own idle targets,
+	// independently of the main pool and of the Limit applied to it
+	MachineFlavors []*DockerMachineFlavor `toml:"MachineFlavors,omitempty"`
+
+	// ProjectAffinity makes a job prefer the idle machine that last ran
+	// the same project, to benefit from its warm caches. The preference
+	// is soft: a busy affine machine is never waited for
+	ProjectAffinity bool `long:"machine-project-affinity" env:"MACHINE_PROJECT_AFFINITY" description:"Prefer the idle machine that last ran a job of the same project"`
+
+	// AffinityKey is derived at runtime from the job; it is never read
+	// from the configuration file
+	AffinityKey   string  `toml:"-"`
+	StoragePath   string  `long:"machine-storage-path" env:"MACHINE_STORAGE_PATH" description:"The docker-machine storage path used to isolate the machine store of this runner"`
+	MachineBinary string  `long:"machine-binary" env:"MACHINE_BINARY" description:"Path to the docker-machine binary, when the one on PATH is not the right version"`
+	HourlyCost    float64 `long:"machine-hourly-cost" env:"MACHINE_HOURLY_COST" description:"Estimated hourly cost of a single machine"`
+	MonthlyBudget float64 `long:"machine-monthly-budget" env:"MACHINE_MONTHLY_BUDGET" description:"Soft monthly cost budget above which no new machines are created"`
+
+	// MetricsLabels are constant label key/values stamped on every metric
+	// the autoscaling provider emits, so that the series can be split by
+	// team or environment for chargeback
+	MetricsLabels map[string]string `toml:"MetricsLabels,omitempty"`
+
+	ShutdownTimeout     int  `long:"machine-shutdown-timeout" env:"MACHINE_SHUTDOWN_TIMEOUT" description:"Seconds to wait for busy machines when draining the pool on shutdown"`
+	ShutdownForceRemove bool `long:"machine-shutdown-force-remove" env:"MACHINE_SHUTDOWN_FORCE_REMOVE" description:"Force-remove machines that are still busy when the shutdown timeout expires"`
+
+	// TeardownOrder picks which machines a shutdown drain removes
+	// first: "idle-first" (the default) cordons the idle machines right
+	// away while builds finish, "busy-first" keeps them until every
+	// building machine is gone
+	TeardownOrder string `long:"machine-teardown-order" env:"MACHINE_TEARDOWN_ORDER" description:"Which machines a shutdown drain removes first: idle-first (default) or busy-first"`
+
+	// MaxConcurrentBuilds allows packing several simultaneous builds onto
+	// one machine; 0 or 1 keeps the classic one-build-per-machine model
+	MaxConcurrentBuilds int `long:"machine-max-concurrent-builds" env:"MACHINE_MAX_CONCURRENT_BUILDS" description:"Maximum number of builds processed simultaneously by a single machine"`
+
+	// CreationTimeout flags machines that spend longer than the given
+	// number of seconds provisioning as stuck, so that the scaling sweep
+	// replaces them; time spent waiting in the creation queue is free
+	CreationTimeout int `long:"machine-creation-timeout" env:"MACHINE_CREATION_TIMEOUT" description:"Seconds a machine may spend provisioning before it counts as stuck"`
+
+	// MinCreationSuccessRate flips the provider's health signal to
+	// unhealthy when the percentage of successful creates in the recent
+	// window drops below it; purely for monitoring, nothing is blocked
+	MinCreationSuccessRate int `long:"machine-min-creation-success-rate" env:"MACHINE_MIN_CREATION_SUCCESS_RATE" description:"Minimum percentage of recent successful machine creations below which the provider reports unhealthy (0 = disabled)"`
+
+	// MaxTotalMachines caps the machines of all runner configs sharing
+	// this provider combined, protecting a shared host or cloud quota
+	// that the per-config Limit values cannot see
+	MaxTotalMachines int `long:"max-total-machines" env:"MACHINE_MAX_TOTAL_MACHINES" description:"Maximum number of machines across all runner configs sharing this provider"`
+
+	// AcquireTimeout caps the whole on-demand acquire chain — create,
+	// connect and credential fetch with all their retries combined — so
+	// that a struggling driver can't block job scheduling indefinitely
+	AcquireTimeout int `long:"machine-acquire-timeout" env:"MACHINE_ACQUIRE_TIMEOUT" description:"Seconds the whole on-demand machine acquisition may take before it is aborted"`
+
+	// ProvisionRetryMode picks how a failed machine provisioning is
+	// recovered: "inplace" (the default) re-runs Provision on the host
+	// that was already created, "replace" throws it away and creates a
+	// fresh machine, for drivers that can't re-provision a broken host
+	ProvisionRetryMode string `long:"machine-provision-retry-mode" env:"MACHINE_PROVISION_RETRY_MODE" description:"How to recover failed provisioning: inplace (default) or replace"`
+
+	// MaxQueueWait is how many seconds a blocking acquire favors reuse
+	// before it falls back to creating a machine on demand, as long as
+	// the Limit leaves headroom for one
+	MaxQueueWait int `long:"machine-max-queue-wait" env:"MACHINE_MAX_QUEUE_WAIT" description:"Seconds a blocking acquire waits for a released machine before creating one on demand"`
+
+	// MaxWeight caps the summed flavor weights of all machines instead of
+	// their raw count, so that with mixed sizes two big machines can
+	// consume as much capacity as four small ones. Zero disables the cap
+	MaxWeight int `long:"machine-max-weight" env:"MACHINE_MAX_WEIGHT" description:"Maximum summed weight of all machines (0 = no weight cap)"`
+
+	// MaxCredentialFailures removes a machine after this many consecutive
+	// Credentials errors; a host that keeps connecting fine but never
+	// yields usable credentials is usually broken. Zero keeps the old
+	// behavior of releasing the machine back to idle
+	MaxCredentialFailures int `long:"machine-max-credential-failures" env:"MACHINE_MAX_CREDENTIAL_FAILURES" description:"Remove a machine after this many consecutive credential failures (0 = always release to idle)"`
+
+	// ReleaseCooldown keeps a just-released machine out of selection for
+	// the given number of seconds, giving heavy builds a moment to flush
+	// disks and write back caches before the next job lands
+	ReleaseCooldown int `long:"machine-release-cooldown" env:"MACHINE_RELEASE_COOLDOWN" description:"Seconds a released machine stays unselectable before it can take the next build"`
+
+	// NoCreate makes acquiring a machine fail fast when no free machine
+	// exists, instead of triggering a slow on-demand creation; useful
+	// when the job can be handed to a different runner instead
+	NoCreate bool `long:"machine-no-create" env:"MACHINE_NO_CREATE" description:"Fail instead of creating a machine on demand when no free machine exists"`
+
+	// QuarantineTime parks machines that fail their health check for the
+	// given number of seconds instead of removing them right away, so
+	// that they can be inspected before they are destroyed
+	QuarantineTime int `toml:"QuarantineTime,omitzero" long:"machine-quarantine-time" env:"MACHINE_QUARANTINE_TIME" description:"Seconds to keep unhealthy machines around for inspection before removing them"`
+
+	// ScalingInterval is the base tick of the background scaling loop;
+	// ScalingJitter desynchronizes the ticks of runners sharing a host,
+	// defaulting to a tenth of the base interval
+	ScalingInterval int `long:"machine-scaling-interval" env:"MACHINE_SCALING_INTERVAL" description:"Base interval in seconds between scaling loop ticks"`
+	ScalingJitter   int `long:"machine-scaling-jitter" env:"MACHINE_SCALING_JITTER" description:"Maximum random jitter in seconds added to each scaling loop tick"`
+
+	// HeartbeatInterval is the tick of the background heartbeat that
+	// probes idle machines for reachability; HeartbeatConcurrency bounds
+	// how many probes run at once during a sweep
+	HeartbeatInterval    int `long:"machine-heartbeat-interval" env:"MACHINE_HEARTBEAT_INTERVAL" description:"Interval in seconds between idle machine reachability sweeps"`
+	HeartbeatConcurrency int `long:"machine-heartbeat-concurrency" env:"MACHINE_HEARTBEAT_CONCURRENCY" description:"Maximum number of concurrent reachability probes per sweep"`
+
+	ConnectRetries       int `long:"machine-connect-retries" env:"MACHINE_CONNECT_RETRIES" description:"Number of times to retry connecting to an acquired machine before giving up"`
+	ConnectRetryInterval int `long:"machine-connect-retry-interval" env:"MACHINE_CONNECT_RETRY_INTERVAL" description:"Base interval in seconds between machine connect retries"`
+	MaxCreateConcurrency int `long:"machine-max-create-concurrency" env:"MACHINE_MAX_CREATE_CONCURRENCY" description:"Maximum number of concurrent machine creations (0 = unlimited)"`
+	MaxRemoveConcurrency int `long:"machine-max-remove-concurrency" env:"MACHINE_MAX_REMOVE_CONCURRENCY" description:"Maximum number of concurrent machine removals (0 = unlimited)"`
+
+	// MaxOperationConcurrency caps the background goroutines of all
+	// machine operations combined, on top of the per-operation limits
+	// above; excess operations queue until a running one finishes
+	MaxOperationConcurrency int `long:"machine-max-operation-concurrency" env:"MACHINE_MAX_OPERATION_CONCURRENCY" description:"Overall cap on concurrent background machine operations (0 = unlimited)"`
 
 	OffPeakPeriods   []string `long:"off-peak-periods" env:"MACHINE_OFF_PEAK_PERIODS" description:"Time periods when the scheduler is in the OffPeak mode"`
 	OffPeakTimezone  string   `long:"off-peak-timezone" env:"MACHINE_OFF_PEAK_TIMEZONE" description:"Timezone for the OffPeak periods (defaults to Local)"`
@@ -290,6 +503,7 @@ type RunnerSettings struct {
 type RunnerConfig struct {
 	Name               string `toml:"name" json:"name" short:"name" long:"description" env:"RUNNER_NAME" description:"Runner name"`
 	Limit              int    `toml:"limit,omitzero" json:"limit" long:"limit" env:"RUNNER_LIMIT" description:"Maximum number of builds processed by this runner"`
+	LimitBurst         int    `toml:"limit_burst,omitzero" json:"limit_burst" long:"limit-burst" env:"RUNNER_LIMIT_BURST" description:"Maximum number of machines created above the limit during demand spikes"`
 	OutputLimit        int    `toml:"output_limit,omitzero" long:"output-limit" env:"RUNNER_OUTPUT_LIMIT" description:"Maximum build trace size in kilobytes"`
 	RequestConcurrency int    `toml:"request_concurrency,omitzero" long:"request-concurrency" env:"RUNNER_REQUEST_CONCURRENCY" description:"Maximum concurrency for job requests"`
 
@@ -509,6 +723,194 @@ func (c *DockerMachine) CompileOffPeakPeriods() (err error) {
 	return
 }
 
+// validateOptionTemplates makes sure every machine option parses as a
+// template, so that a typo like an unclosed token surfaces at config
+// load instead of at the first machine creation
+func validateOptionTemplates(options []string) error {
+	for _, option := range options {
+		if !strings.Contains(option, "{{") {
+			continue
+		}
+		if _, err := template.New("machine-option").Parse(option); err != nil {
+			return fmt.Errorf("invalid MachineOptions template %q: %v", option, err)
+		}
+	}
+	return nil
+}
+
+// Validate rejects contradictory machine settings at load time, before
+// the provider gets a chance to act on them
+func (c *DockerMachine) Validate(limit int) error {
+	if !strings.Contains(c.MachineName, "%s") {
+		return fmt.Errorf("MachineName %q needs to include a %%s placeholder", c.MachineName)
+	}
+	if c.NameSuffixLength < 0 {
+		return errors.New("NameSuffixLength must not be negative")
+	}
+	if c.MaxNameLength > 0 {
+		suffix := c.NameSuffixLength
+		if suffix == 0 {
+			// The default suffix is the 10 digit unix timestamp, a
+			// separator and 8 random characters
+			suffix = 19
+		}
+		// Every machine name also carries the "runner-<short token>-"
+		// prefix derived from the runner credentials
+		longest := len("runner--") + 8 +
+			len(strings.Replace(c.MachineName, "%s", "", 1)) + suffix
+		if longest > c.MaxNameLength {
+			return fmt.Errorf("MachineName %q can generate names of up to %d characters, above MaxNameLength of %d", c.MachineName, longest, c.MaxNameLength)
+		}
+	}
+	switch c.Mode {
+	case "", "pre-create", "on-demand":
+	default:
+		return fmt.Errorf("unsupported Mode %q, expected pre-create or on-demand", c.Mode)
+	}
+	if c.IdleCount < 0 {
+		return errors.New("IdleCount must not be negative")
+	}
+	if c.Mode == "pre-create" && c.IdleCount <= 0 {
+		return errors.New("pre-create Mode requires a positive IdleCount")
+	}
+	if c.MinIdleCount < 0 {
+		return errors.New("MinIdleCount must not be negative")
+	}
+	if c.IdlePercentOfPeak < 0 {
+		return errors.New("IdlePercentOfPeak must not be negative")
+	}
+	if c.IdleCountMax < 0 {
+		return errors.New("IdleCountMax must not be negative")
+	}
+	if c.IdleTime < 0 {
+		return errors.New("IdleTime must not be negative")
+	}
+	switch c.RemovalStrategy {
+	case "", "oldest-first", "youngest-first", "most-used-first":
+	default:
+		return fmt.Errorf("unsupported RemovalStrategy %q, expected oldest-first, youngest-first or most-used-first", c.RemovalStrategy)
+	}
+	if c.MaxBuilds < 0 {
+		return errors.New("MaxBuilds must not be negative")
+	}
+	switch c.CountBuildsAt {
+	case "", "start", "finish":
+	default:
+		return fmt.Errorf("unsupported CountBuildsAt %q, expected start or finish", c.CountBuildsAt)
+	}
+	if c.MaxMachineUseTime < 0 {
+		return errors.New("MaxMachineUseTime must not be negative")
+	}
+	if c.MaxBuildFailures < 0 {
+		return errors.New("MaxBuildFailures must not be negative")
+	}
+	if c.StandbyCount < 0 {
+		return errors.New("StandbyCount must not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("ShutdownTimeout must not be negative")
+	}
+	switch c.TeardownOrder {
+	case "", "idle-first", "busy-first":
+	default:
+		return fmt.Errorf("unsupported TeardownOrder %q, expected idle-first or busy-first", c.TeardownOrder)
+	}
+	if c.QuarantineTime < 0 {
+		return errors.New("QuarantineTime must not be negative")
+	}
+	if c.MaxQueueWait < 0 {
+		return errors.New("MaxQueueWait must not be negative")
+	}
+	if c.AcquireTimeout < 0 {
+		return errors.New("AcquireTimeout must not be negative")
+	}
+	switch c.ProvisionRetryMode {
+	case "", "inplace", "replace":
+	default:
+		return fmt.Errorf("unsupported ProvisionRetryMode %q, expected inplace or replace", c.ProvisionRetryMode)
+	}
+	if c.MaxWeight < 0 {
+		return errors.New("MaxWeight must not be negative")
+	}
+	if c.MaxCredentialFailures < 0 {
+		return errors.New("MaxCredentialFailures must not be negative")
+	}
+	if c.ReleaseCooldown < 0 {
+		return errors.New("ReleaseCooldown must not be negative")
+	}
+	if c.MaxTotalMachines < 0 {
+		return errors.New("MaxTotalMachines must not be negative")
+	}
+	if c.CreationTimeout < 0 {
+		return errors.New("CreationTimeout must not be negative")
+	}
+	if c.MinCreationSuccessRate < 0 || c.MinCreationSuccessRate > 100 {
+		return errors.New("MinCreationSuccessRate must be a percentage between 0 and 100")
+	}
+	if c.MaxConcurrentBuilds < 0 {
+		return errors.New("MaxConcurrentBuilds must not be negative")
+	}
+	if c.ScalingInterval < 0 || c.ScalingJitter < 0 {
+		return errors.New("ScalingInterval and ScalingJitter must not be negative")
+	}
+	if c.HeartbeatInterval < 0 || c.HeartbeatConcurrency < 0 {
+		return errors.New("HeartbeatInterval and HeartbeatConcurrency must not be negative")
+	}
+	if limit > 0 && c.IdleCount > limit {
+		return fmt.Errorf("IdleCount of %d exceeds the runner limit of %d", c.IdleCount, limit)
+	}
+
+	if c.UserData != "" && !strings.Contains(c.UserData, "\n") {
+		if _, err := os.Stat(c.UserData); err != nil {
+			return fmt.Errorf("UserData file %q is not readable: %v", c.UserData, err)
+		}
+	}
+	for name := range c.MetricsLabels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid MetricsLabels name %q", name)
+		}
+	}
+
+	if err := validateOptionTemplates(c.MachineOptions); err != nil {
+		return err
+	}
+
+	for _, flavor := range c.MachineFlavors {
+		if flavor.Name == "" {
+			return errors.New("MachineFlavors entries need a Name")
+		}
+		if err := validateOptionTemplates(flavor.MachineOptions); err != nil {
+			return err
+		}
+		if flavor.IdleCount < 0 || flavor.IdleTime < 0 {
+			return fmt.Errorf("MachineFlavors entry %q must not use negative idle settings", flavor.Name)
+		}
+		if flavor.Limit < 0 {
+			return fmt.Errorf("MachineFlavors entry %q must not use a negative Limit", flavor.Name)
+		}
+		if flavor.Weight < 0 {
+			return fmt.Errorf("MachineFlavors entry %q must not use a negative Weight", flavor.Name)
+		}
+		for _, fallback := range flavor.FlavorFallback {
+			if fallback == flavor.Name {
+				return fmt.Errorf("MachineFlavors entry %q must not fall back to itself", flavor.Name)
+			}
+			found := false
+			for _, other := range c.MachineFlavors {
+				if other.Name == fallback {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("MachineFlavors entry %q falls back to unknown flavor %q", flavor.Name, fallback)
+			}
+		}
+	}
+
+	return nil
+}
+
 func (c *RunnerCredentials) GetURL() string {
 	return c.URL
 }
@@ -629,6 +1031,10 @@ func (c *Config) LoadConfig(configFile string) error {
 		if err != nil {
 			return err
 		}
+
+		if err := runner.Machine.Validate(runner.Limit); err != nil {
+			return fmt.Errorf("invalid [runners.machine] section for %q: %v", runner.Name, err)
+		}
 	}
 
 	c.ModTime = info.ModTime()
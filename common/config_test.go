@@ -0,0 +1,378 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerMachineValidate(t *testing.T) {
+	validMachine := func() *DockerMachine {
+		return &DockerMachine{
+			MachineName: "runner-%s",
+			IdleCount:   2,
+			IdleTime:    600,
+			MaxBuilds:   10,
+		}
+	}
+
+	tests := map[string]struct {
+		machine       func() *DockerMachine
+		limit         int
+		expectedError string
+	}{
+		"valid baseline": {
+			machine: validMachine,
+			limit:   4,
+		},
+		"machine name without placeholder": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MachineName = "runner"
+				return m
+			},
+			expectedError: "needs to include a %s placeholder",
+		},
+		"idle count exceeding limit": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.IdleCount = 5
+				return m
+			},
+			limit:         4,
+			expectedError: "IdleCount of 5 exceeds the runner limit of 4",
+		},
+		"idle count without a limit": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.IdleCount = 5
+				return m
+			},
+		},
+		"negative idle count": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.IdleCount = -1
+				return m
+			},
+			expectedError: "IdleCount must not be negative",
+		},
+		"negative min idle count": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MinIdleCount = -1
+				return m
+			},
+			expectedError: "MinIdleCount must not be negative",
+		},
+		"negative idle time": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.IdleTime = -1
+				return m
+			},
+			expectedError: "IdleTime must not be negative",
+		},
+		"negative max builds": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MaxBuilds = -1
+				return m
+			},
+			expectedError: "MaxBuilds must not be negative",
+		},
+		"negative max machine use time": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MaxMachineUseTime = -1
+				return m
+			},
+			expectedError: "MaxMachineUseTime must not be negative",
+		},
+		"negative standby count": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.StandbyCount = -1
+				return m
+			},
+			expectedError: "StandbyCount must not be negative",
+		},
+		"negative scaling interval": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.ScalingInterval = -1
+				return m
+			},
+			expectedError: "ScalingInterval and ScalingJitter must not be negative",
+		},
+		"negative heartbeat settings": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.HeartbeatInterval = -1
+				return m
+			},
+			expectedError: "HeartbeatInterval and HeartbeatConcurrency must not be negative",
+		},
+		"negative max concurrent builds": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MaxConcurrentBuilds = -1
+				return m
+			},
+			expectedError: "MaxConcurrentBuilds must not be negative",
+		},
+		"negative creation timeout": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.CreationTimeout = -1
+				return m
+			},
+			expectedError: "CreationTimeout must not be negative",
+		},
+		"negative max total machines": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MaxTotalMachines = -1
+				return m
+			},
+			expectedError: "MaxTotalMachines must not be negative",
+		},
+		"negative max credential failures": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MaxCredentialFailures = -1
+				return m
+			},
+			expectedError: "MaxCredentialFailures must not be negative",
+		},
+		"negative release cooldown": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.ReleaseCooldown = -1
+				return m
+			},
+			expectedError: "ReleaseCooldown must not be negative",
+		},
+		"negative quarantine time": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.QuarantineTime = -1
+				return m
+			},
+			expectedError: "QuarantineTime must not be negative",
+		},
+		"negative shutdown timeout": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.ShutdownTimeout = -1
+				return m
+			},
+			expectedError: "ShutdownTimeout must not be negative",
+		},
+		"machine options with a broken template": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MachineOptions = []string{"--amazonec2-region={{.Region"}
+				return m
+			},
+			expectedError: "invalid MachineOptions template",
+		},
+		"flavor without a name": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MachineFlavors = []*DockerMachineFlavor{{}}
+				return m
+			},
+			expectedError: "MachineFlavors entries need a Name",
+		},
+		"negative acquire timeout": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.AcquireTimeout = -1
+				return m
+			},
+			expectedError: "AcquireTimeout must not be negative",
+		},
+		"negative max build failures": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MaxBuildFailures = -1
+				return m
+			},
+			expectedError: "MaxBuildFailures must not be negative",
+		},
+		"negative idle percent of peak": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.IdlePercentOfPeak = -10
+				return m
+			},
+			expectedError: "IdlePercentOfPeak must not be negative",
+		},
+		"negative idle count max": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.IdleCountMax = -1
+				return m
+			},
+			expectedError: "IdleCountMax must not be negative",
+		},
+		"user-data file missing": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.UserData = "/does/not/exist.sh"
+				return m
+			},
+			expectedError: `UserData file "/does/not/exist.sh" is not readable`,
+		},
+		"generated names exceed the length cap": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MaxNameLength = 30
+				return m
+			},
+			expectedError: "above MaxNameLength of 30",
+		},
+		"negative name suffix length": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.NameSuffixLength = -1
+				return m
+			},
+			expectedError: "NameSuffixLength must not be negative",
+		},
+		"unknown teardown order": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.TeardownOrder = "random"
+				return m
+			},
+			expectedError: `unsupported TeardownOrder "random"`,
+		},
+		"creation success rate over 100": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MinCreationSuccessRate = 101
+				return m
+			},
+			expectedError: "MinCreationSuccessRate must be a percentage between 0 and 100",
+		},
+		"invalid metrics label name": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MetricsLabels = map[string]string{"team name": "ci"}
+				return m
+			},
+			expectedError: `invalid MetricsLabels name "team name"`,
+		},
+		"unknown removal strategy": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.RemovalStrategy = "random"
+				return m
+			},
+			expectedError: `unsupported RemovalStrategy "random"`,
+		},
+		"unknown scaling mode": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.Mode = "reactive"
+				return m
+			},
+			expectedError: `unsupported Mode "reactive"`,
+		},
+		"pre-create mode without idle machines": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.Mode = "pre-create"
+				m.IdleCount = 0
+				return m
+			},
+			expectedError: "pre-create Mode requires a positive IdleCount",
+		},
+		"unknown provision retry mode": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.ProvisionRetryMode = "reboot"
+				return m
+			},
+			expectedError: `unsupported ProvisionRetryMode "reboot"`,
+		},
+		"negative max queue wait": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MaxQueueWait = -1
+				return m
+			},
+			expectedError: "MaxQueueWait must not be negative",
+		},
+		"negative max weight": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MaxWeight = -1
+				return m
+			},
+			expectedError: "MaxWeight must not be negative",
+		},
+		"flavor with negative weight": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MachineFlavors = []*DockerMachineFlavor{{Name: "big", Weight: -1}}
+				return m
+			},
+			expectedError: `MachineFlavors entry "big" must not use a negative Weight`,
+		},
+		"flavor with negative idle settings": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MachineFlavors = []*DockerMachineFlavor{{Name: "large", IdleCount: -1}}
+				return m
+			},
+			expectedError: `MachineFlavors entry "large" must not use negative idle settings`,
+		},
+		"unknown build counting point": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.CountBuildsAt = "halfway"
+				return m
+			},
+			expectedError: `unsupported CountBuildsAt "halfway", expected start or finish`,
+		},
+		"flavor falling back to an unknown flavor": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MachineFlavors = []*DockerMachineFlavor{{Name: "spot", FlavorFallback: []string{"ondemand"}}}
+				return m
+			},
+			expectedError: `MachineFlavors entry "spot" falls back to unknown flavor "ondemand"`,
+		},
+		"flavor falling back to itself": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MachineFlavors = []*DockerMachineFlavor{{Name: "spot", FlavorFallback: []string{"spot"}}}
+				return m
+			},
+			expectedError: `MachineFlavors entry "spot" must not fall back to itself`,
+		},
+		"flavor with negative limit": {
+			machine: func() *DockerMachine {
+				m := validMachine()
+				m.MachineFlavors = []*DockerMachineFlavor{{Name: "gpu", Limit: -1}}
+				return m
+			},
+			expectedError: `MachineFlavors entry "gpu" must not use a negative Limit`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.machine().Validate(test.limit)
+			if test.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedError)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package machine
+
+import (
+	"sync"
+	"time"
+)
+
+// removalAuditEntry records a single machine removal, so that it can be
+// inspected after the machine details are already gone
+type removalAuditEntry struct {
+	Time   time.Time
+	Name   string
+	Reason string
+	Age    time.Duration
+}
+
+// removalAudit is an append-only, bounded ring buffer of machine removals,
+// kept to answer "why did my machine disappear" post-mortems
+type removalAudit struct {
+	lock    sync.Mutex
+	size    int
+	entries []removalAuditEntry
+}
+
+func newRemovalAudit(size int) *removalAudit {
+	if size <= 0 {
+		size = removalAuditSize
+	}
+	return &removalAudit{size: size}
+}
+
+func (a *removalAudit) Add(details *machineDetails) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.entries = append(a.entries, removalAuditEntry{
+		Time:   time.Now(),
+		Name:   details.Name,
+		Reason: details.Reason,
+		Age:    time.Since(details.Created),
+	})
+	if len(a.entries) > a.size {
+		a.entries = a.entries[len(a.entries)-a.size:]
+	}
+}
+
+func (a *removalAudit) Entries() []removalAuditEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entries := make([]removalAuditEntry, len(a.entries))
+	copy(entries, a.entries)
+	return entries
+}
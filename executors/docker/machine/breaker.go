@@ -0,0 +1,58 @@
+package machine
+
+import (
+	"sync"
+	"time"
+)
+
+// creationBreaker is a circuit breaker for machine creation: a streak of
+// consecutive create failures (e.g. a cloud outage) opens it, making
+// further creation attempts fail fast for a cooldown instead of wasting
+// resources and spamming logs. After the cooldown a single probe create
+// is let through (half-open); its success closes the breaker again
+type creationBreaker struct {
+	lock sync.Mutex
+
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether a creation attempt may proceed
+func (b *creationBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.failures < creationBreakerThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) {
+		return false
+	}
+
+	// Half-open: let exactly one probe create through
+	if b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *creationBreaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *creationBreaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.failures >= creationBreakerThreshold {
+		b.openUntil = time.Now().Add(creationBreakerCooldown)
+	}
+}
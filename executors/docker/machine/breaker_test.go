@@ -0,0 +1,54 @@
+package machine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreationBreaker(t *testing.T) {
+	b := &creationBreaker{}
+
+	for i := 0; i < creationBreakerThreshold; i++ {
+		assert.True(t, b.allow())
+		b.failure()
+	}
+	assert.False(t, b.allow(), "the breaker should open after the failure streak")
+
+	b.openUntil = time.Now().Add(-time.Second)
+	assert.True(t, b.allow(), "the breaker should half-open after the cooldown")
+	assert.False(t, b.allow(), "only a single probe may pass while half-open")
+
+	b.success()
+	assert.True(t, b.allow(), "a successful probe should close the breaker")
+}
+
+func TestMachineCreationBreaker(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, _ := testMachineProvider()
+	config := createMachineConfig(0, 5)
+	config.Machine.MachineName = "provision-fail-%s"
+
+	for i := 0; i < creationBreakerThreshold; i++ {
+		_, errCh := p.create(config, machineStateIdle)
+		assert.Error(t, <-errCh)
+	}
+
+	details, errCh := p.create(config, machineStateIdle)
+	assert.Nil(t, details, "an open breaker should fail creation fast")
+	assert.EqualError(t, <-errCh, "machine creation is suspended after repeated failures")
+
+	// After the cooldown a successful probe closes the breaker again
+	p.breaker.openUntil = time.Now().Add(-time.Second)
+	config.Machine.MachineName = "test-machine-%s"
+
+	details, errCh = p.create(config, machineStateIdle)
+	assert.NotNil(t, details)
+	assert.NoError(t, <-errCh)
+
+	details, errCh = p.create(config, machineStateIdle)
+	assert.NotNil(t, details, "the breaker should be closed after the probe succeeded")
+	assert.NoError(t, <-errCh)
+}
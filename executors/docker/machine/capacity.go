@@ -0,0 +1,147 @@
+package machine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CapacityError is returned when an acquire finds no free machine in a
+// pool running at its limit; it carries the numbers a caller needs to
+// pick a sensible retry time instead of polling blindly
+type CapacityError struct {
+	// Used is how many machines currently run or are about to run a
+	// build
+	Used int
+	// Limit is the configured machine ceiling of the pool
+	Limit int
+	// EstimatedWait is how long until a machine likely frees up, based
+	// on the recent build durations; zero when there is no data yet
+	EstimatedWait time.Duration
+}
+
+func (e *CapacityError) Error() string {
+	msg := "No free machines that can process builds"
+	if e.Limit > 0 {
+		msg += fmt.Sprintf(": %d of %d machines in use", e.Used, e.Limit)
+	}
+	if e.EstimatedWait > 0 {
+		msg += fmt.Sprintf(", estimated wait %s", e.EstimatedWait)
+	}
+	return msg
+}
+
+// recordBuildDuration keeps the durations of the most recent builds;
+// their average feeds the wait estimate handed back at saturation
+func (m *machineProvider) recordBuildDuration(d time.Duration) {
+	m.buildDurationsLock.Lock()
+	defer m.buildDurationsLock.Unlock()
+
+	m.recentBuilds = append(m.recentBuilds, d)
+	if len(m.recentBuilds) > recentBuildWindow {
+		m.recentBuilds = m.recentBuilds[len(m.recentBuilds)-recentBuildWindow:]
+	}
+}
+
+func (m *machineProvider) averageBuildDuration() time.Duration {
+	m.buildDurationsLock.Lock()
+	defer m.buildDurationsLock.Unlock()
+
+	if len(m.recentBuilds) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range m.recentBuilds {
+		sum += d
+	}
+	return sum / time.Duration(len(m.recentBuilds))
+}
+
+// capacityError snapshots the pool numbers for a refused acquire. The
+// wait estimate assumes the longest-running build is the one most
+// likely to finish first
+func (m *machineProvider) capacityError(limit int, data *machinesData) *CapacityError {
+	capErr := &CapacityError{
+		Used:  data.Used + data.Acquired,
+		Limit: limit,
+	}
+
+	average := m.averageBuildDuration()
+	if average <= 0 {
+		return capErr
+	}
+
+	var maxElapsed time.Duration
+	m.machines().each(func(details *machineDetails) {
+		if details.State != machineStateUsed {
+			return
+		}
+		if elapsed := time.Since(details.Used); elapsed > maxElapsed {
+			maxElapsed = elapsed
+		}
+	})
+	if wait := average - maxElapsed; wait > 0 {
+		capErr.EstimatedWait = wait
+	}
+	return capErr
+}
+
+// capacityNotifier tells subscribed schedulers the instant the pool
+// goes from saturated back to having an acquirable machine, instead of
+// making them poll. Signals are coalesced: however many machines free
+// up at once, the subscribers hear about it a single time until the
+// pool saturates again
+type capacityNotifier struct {
+	lock      sync.Mutex
+	callbacks []func()
+	saturated bool
+}
+
+// subscribe registers fn for the next saturated-to-available
+// transition; it is invoked on its own goroutine, outside any provider
+// lock, and keeps firing on every later transition
+func (c *capacityNotifier) subscribe(fn func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.callbacks = append(c.callbacks, fn)
+}
+
+// markSaturated records that an acquire found no usable machine, arming
+// the next available signal
+func (c *capacityNotifier) markSaturated() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.saturated = true
+}
+
+// notifyAvailable fires the callbacks when the pool was saturated; the
+// signal is swallowed otherwise
+func (c *capacityNotifier) notifyAvailable() {
+	c.lock.Lock()
+	if !c.saturated {
+		c.lock.Unlock()
+		return
+	}
+	c.saturated = false
+	callbacks := make([]func(), len(c.callbacks))
+	copy(callbacks, c.callbacks)
+	c.lock.Unlock()
+
+	if len(callbacks) == 0 {
+		return
+	}
+	go func() {
+		for _, fn := range callbacks {
+			fn()
+		}
+	}()
+}
+
+// OnCapacityAvailable subscribes fn to the moment the pool transitions
+// from fully busy or capped to having an acquirable machine again, e.g.
+// when a build releases its machine or a pending create completes
+func (m *machineProvider) OnCapacityAvailable(fn func()) {
+	m.capacity.subscribe(fn)
+}
@@ -0,0 +1,90 @@
+package machine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachineCapacityAvailableCallback(t *testing.T) {
+	p, _ := testMachineProvider()
+	config := createMachineConfig(1, 5)
+	config.Limit = 1
+
+	p.Acquire(config)
+	assertIdleMachines(t, p, 1)
+
+	d, err := p.Acquire(config)
+	assert.NoError(t, err)
+	assert.NotNil(t, d)
+
+	_, err = p.Acquire(config)
+	assert.Error(t, err, "the pool should be saturated")
+
+	fired := make(chan struct{}, 1)
+	p.OnCapacityAvailable(func() {
+		fired <- struct{}{}
+	})
+
+	p.Release(config, d)
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("releasing a machine into a saturated pool should fire the callback")
+	}
+
+	// Without a new saturation in between, further releases stay silent
+	d, err = p.Acquire(config)
+	assert.NoError(t, err)
+	p.Release(config, d)
+
+	select {
+	case <-fired:
+		t.Fatal("the signal must be coalesced until the pool saturates again")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMachineCapacityErrorOnSaturation(t *testing.T) {
+	p, _ := testMachineProvider()
+	config := createMachineConfig(1, 5)
+	config.Limit = 1
+
+	p.Acquire(config)
+	assertIdleMachines(t, p, 1)
+
+	data, err := p.Acquire(config)
+	assert.NoError(t, err)
+	d := data.(*machineDetails)
+	d.State = machineStateUsed
+	d.ActiveBuilds = 1
+	d.Used = time.Now().Add(-time.Minute)
+
+	// Recent builds took ten minutes on average and the running one is a
+	// minute in, so a machine should free up in roughly nine
+	p.recordBuildDuration(10 * time.Minute)
+
+	_, err = p.Acquire(config)
+	capErr, ok := err.(*CapacityError)
+	if !ok {
+		t.Fatalf("expected a *CapacityError, got %v", err)
+	}
+	assert.Equal(t, 1, capErr.Used)
+	assert.Equal(t, 1, capErr.Limit)
+	assert.True(t, capErr.EstimatedWait > 8*time.Minute, "wait estimate too low: %s", capErr.EstimatedWait)
+	assert.True(t, capErr.EstimatedWait <= 9*time.Minute, "wait estimate too high: %s", capErr.EstimatedWait)
+	assert.Contains(t, capErr.Error(), "1 of 1 machines in use")
+
+	// Without duration data the numbers still come back, just without an
+	// estimate
+	p.recentBuilds = nil
+	_, err = p.Acquire(config)
+	capErr, ok = err.(*CapacityError)
+	if !ok {
+		t.Fatalf("expected a *CapacityError, got %v", err)
+	}
+	assert.Equal(t, 1, capErr.Used)
+	assert.Zero(t, capErr.EstimatedWait)
+}
@@ -0,0 +1,80 @@
+package machine
+
+import (
+	"fmt"
+	"sync"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+	docker_helpers "gitlab.com/gitlab-org/gitlab-runner/helpers/docker"
+)
+
+// dockerClientCache keeps the Docker client that the builds running on
+// one machine share, so that concurrent builds don't pay the connection
+// and TLS setup over and over. The cache holds a single client, keyed by
+// the credentials it was dialed with: changed credentials replace it
+type dockerClientCache struct {
+	lock   sync.Mutex
+	key    string
+	client docker_helpers.Client
+
+	// dial is swappable for tests; it defaults to docker_helpers.New
+	dial func(docker_helpers.DockerCredentials, string) (docker_helpers.Client, error)
+}
+
+// credentialsKey folds the connection-relevant parts of the credentials
+// into the cache key, so a cert or endpoint change misses the cache
+func credentialsKey(dc docker_helpers.DockerCredentials) string {
+	return fmt.Sprintf("%s|%s|%t", dc.Host, dc.CertPath, dc.TLSVerify)
+}
+
+// get returns the cached client while the credentials still match,
+// dialing a fresh one otherwise
+func (c *dockerClientCache) get(dc docker_helpers.DockerCredentials) (docker_helpers.Client, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := credentialsKey(dc)
+	if c.client != nil && c.key == key {
+		return c.client, nil
+	}
+
+	dial := c.dial
+	if dial == nil {
+		dial = docker_helpers.New
+	}
+	client, err := dial(dc, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if c.client != nil {
+		c.client.Close()
+	}
+	c.client = client
+	c.key = key
+	return client, nil
+}
+
+// invalidate closes and drops the cached client, e.g. when the machine
+// is removed or its certificates were regenerated
+func (c *dockerClientCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+		c.key = ""
+	}
+}
+
+// DockerClient returns the Docker client for the machine behind data,
+// reusing the connection that the machine's previous builds dialed when
+// the credentials are unchanged
+func (m *machineProvider) DockerClient(data common.ExecutorData, dc docker_helpers.DockerCredentials) (docker_helpers.Client, error) {
+	details, ok := data.(*machineDetails)
+	if !ok || details.clients == nil {
+		return docker_helpers.New(dc, "")
+	}
+	return details.clients.get(dc)
+}
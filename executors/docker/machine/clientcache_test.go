@@ -0,0 +1,44 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	docker_helpers "gitlab.com/gitlab-org/gitlab-runner/helpers/docker"
+)
+
+func TestMachineDockerClientReuse(t *testing.T) {
+	p, _ := testMachineProvider("machine1")
+	details := p.machineDetails("machine1", false)
+
+	dialed := 0
+	details.clients.dial = func(dc docker_helpers.DockerCredentials, apiVersion string) (docker_helpers.Client, error) {
+		dialed++
+		client := &docker_helpers.MockClient{}
+		client.On("Close").Return(nil)
+		return client, nil
+	}
+
+	dc := docker_helpers.DockerCredentials{Host: "tcp://machine1:2376"}
+	first, err := p.DockerClient(details, dc)
+	assert.NoError(t, err)
+	second, err := p.DockerClient(details, dc)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dialed, "the second use should reuse the dialed client")
+	assert.True(t, first == second, "both uses should see the same client")
+
+	// Changed credentials miss the cache and replace the client
+	dc.CertPath = "/certs/machine1"
+	dc.TLSVerify = true
+	third, err := p.DockerClient(details, dc)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dialed, "new credentials should dial a fresh client")
+	assert.False(t, third == first)
+
+	// Removal drops the cached connection
+	p.remove("machine1", "test")
+	_, err = p.DockerClient(details, dc)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, dialed, "a removed machine must not hand back its stale client")
+}
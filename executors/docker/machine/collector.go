@@ -2,17 +2,85 @@ package machine
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
 )
 
-func (m *machineProvider) collectDetails() (data machinesData) {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
+// buildMetrics (re)creates the provider's metric instruments with the
+// given constant labels stamped on all of them
+func (m *machineProvider) buildMetrics(constLabels prometheus.Labels) {
+	m.totalActions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "gitlab_runner_autoscaling_actions_total",
+			Help:        "The total number of actions executed by the provider.",
+			ConstLabels: constLabels,
+		},
+		[]string{"action"},
+	)
+	m.currentStatesDesc = prometheus.NewDesc(
+		"gitlab_runner_autoscaling_machine_states",
+		"The current number of machines per state in this provider.",
+		[]string{"state"},
+		constLabels,
+	)
+	m.creationSuccessRateDesc = prometheus.NewDesc(
+		"gitlab_runner_autoscaling_creation_success_rate",
+		"The percentage of successful machine creations in the recent window.",
+		nil,
+		constLabels,
+	)
+	m.acquireWaitersDesc = prometheus.NewDesc(
+		"gitlab_runner_autoscaling_acquire_waiters",
+		"The current number of Acquire calls waiting for a machine.",
+		nil,
+		constLabels,
+	)
+	m.workQueueDepthDesc = prometheus.NewDesc(
+		"gitlab_runner_autoscaling_work_queue_depth",
+		"The current number of background operations waiting for the goroutine budget.",
+		nil,
+		constLabels,
+	)
+	m.creationHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:        "gitlab_runner_autoscaling_machine_creation_duration_seconds",
+			Help:        "Histogram of machine creation time.",
+			Buckets:     prometheus.ExponentialBuckets(30, 1.25, 10),
+			ConstLabels: constLabels,
+		},
+	)
+	m.stateDurations = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:        "gitlab_runner_autoscaling_machine_state_duration_seconds",
+			Help:        "Summary of the time machines spend in a state before leaving it.",
+			ConstLabels: constLabels,
+		},
+		[]string{"state"},
+	)
+}
 
-	for _, details := range m.details {
+// applyMetricsLabels rebuilds the metric instruments with the custom
+// labels from the runner config merged into the built-in ones. It runs
+// at most once, before the metrics have accumulated any samples
+func (m *machineProvider) applyMetricsLabels(config *common.RunnerConfig) {
+	if config.Machine == nil || len(config.Machine.MetricsLabels) == 0 {
+		return
+	}
+	m.metricsLabelsOnce.Do(func() {
+		labels := prometheus.Labels{"executor": m.name}
+		for name, value := range config.Machine.MetricsLabels {
+			labels[name] = value
+		}
+		m.buildMetrics(labels)
+	})
+}
+
+func (m *machineProvider) collectDetails() (data machinesData) {
+	m.machines().each(func(details *machineDetails) {
 		if !details.isDead() {
 			data.Add(details)
 		}
-	}
+	})
 	return
 }
 
@@ -20,7 +88,11 @@ func (m *machineProvider) collectDetails() (data machinesData) {
 func (m *machineProvider) Describe(ch chan<- *prometheus.Desc) {
 	m.totalActions.Describe(ch)
 	m.creationHistogram.Describe(ch)
+	m.stateDurations.Describe(ch)
 	ch <- m.currentStatesDesc
+	ch <- m.acquireWaitersDesc
+	ch <- m.creationSuccessRateDesc
+	ch <- m.workQueueDepthDesc
 }
 
 // Collect implements prometheus.Collector.
@@ -32,7 +104,13 @@ func (m *machineProvider) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(m.currentStatesDesc, prometheus.GaugeValue, float64(data.Used), "used")
 	ch <- prometheus.MustNewConstMetric(m.currentStatesDesc, prometheus.GaugeValue, float64(data.Removing), "removing")
 	ch <- prometheus.MustNewConstMetric(m.currentStatesDesc, prometheus.GaugeValue, float64(data.StuckOnRemoving), "stuck-on-removing")
+	ch <- prometheus.MustNewConstMetric(m.currentStatesDesc, prometheus.GaugeValue, float64(data.Standby), "standby")
+	ch <- prometheus.MustNewConstMetric(m.currentStatesDesc, prometheus.GaugeValue, float64(data.Quarantined), "quarantine")
+	ch <- prometheus.MustNewConstMetric(m.acquireWaitersDesc, prometheus.GaugeValue, float64(m.AcquireWaiters()))
+	ch <- prometheus.MustNewConstMetric(m.creationSuccessRateDesc, prometheus.GaugeValue, float64(m.creationHealth.successRate()))
+	ch <- prometheus.MustNewConstMetric(m.workQueueDepthDesc, prometheus.GaugeValue, float64(m.workQueueDepth()))
 
 	m.totalActions.Collect(ch)
 	m.creationHistogram.Collect(ch)
+	m.stateDurations.Collect(ch)
 }
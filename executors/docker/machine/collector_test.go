@@ -7,7 +7,9 @@ import (
 	"gitlab.com/gitlab-org/gitlab-runner/common"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIfMachineProviderExposesCollectInterface(t *testing.T) {
@@ -18,6 +20,75 @@ func TestIfMachineProviderExposesCollectInterface(t *testing.T) {
 	assert.NotNil(t, collector)
 }
 
+func stateDurationSummary(t *testing.T, provider *machineProvider, state string) *dto.Summary {
+	observer, err := provider.stateDurations.GetMetricWithLabelValues(state)
+	require.NoError(t, err)
+
+	var metric dto.Metric
+	require.NoError(t, observer.(prometheus.Metric).Write(&metric))
+	return metric.Summary
+}
+
+func TestMachineStateDurations(t *testing.T) {
+	provider := newMachineProvider("docker_machines", "docker")
+	details := provider.machineDetails("test", false)
+
+	// Pretend the machine sat idle for two seconds before being acquired,
+	// then ran a build for one second
+	details.StateChanged = time.Now().Add(-2 * time.Second)
+	provider.setState(details, machineStateAcquired)
+	details.StateChanged = time.Now().Add(-time.Second)
+	provider.setState(details, machineStateUsed)
+
+	idle := stateDurationSummary(t, provider, machineStateIdle.String())
+	assert.Equal(t, uint64(1), idle.GetSampleCount())
+	assert.InDelta(t, 2.0, idle.GetSampleSum(), 0.1)
+
+	acquired := stateDurationSummary(t, provider, machineStateAcquired.String())
+	assert.Equal(t, uint64(1), acquired.GetSampleCount())
+	assert.InDelta(t, 1.0, acquired.GetSampleSum(), 0.1)
+
+	assert.Equal(t, uint64(0), stateDurationSummary(t, provider, machineStateUsed.String()).GetSampleCount(),
+		"the current state should only be recorded once the machine leaves it")
+}
+
+func TestMachineMetricsLabels(t *testing.T) {
+	provider := newMachineProvider("docker_machines", "docker")
+	config := &common.RunnerConfig{
+		RunnerSettings: common.RunnerSettings{
+			Machine: &common.DockerMachine{
+				MetricsLabels: map[string]string{"team": "ci", "environment": "prod"},
+			},
+		},
+	}
+	provider.applyMetricsLabels(config)
+
+	provider.totalActions.WithLabelValues("created").Inc()
+
+	counter, err := provider.totalActions.GetMetricWithLabelValues("created")
+	require.NoError(t, err)
+
+	var metric dto.Metric
+	require.NoError(t, counter.Write(&metric))
+
+	labels := map[string]string{}
+	for _, pair := range metric.Label {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	assert.Equal(t, "ci", labels["team"])
+	assert.Equal(t, "prod", labels["environment"])
+	assert.Equal(t, "docker_machines", labels["executor"], "the built-in labels should survive")
+	assert.Equal(t, "created", labels["action"])
+
+	// a later sweep with the same config must not rebuild the
+	// instruments and lose the accumulated samples
+	provider.applyMetricsLabels(config)
+	counter, err = provider.totalActions.GetMetricWithLabelValues("created")
+	require.NoError(t, err)
+	require.NoError(t, counter.Write(&metric))
+	assert.Equal(t, 1.0, metric.Counter.GetValue())
+}
+
 func TestMachineProviderDeadInterval(t *testing.T) {
 	provider := newMachineProvider("docker_machines", "docker")
 	assert.Equal(t, 0, provider.collectDetails().Idle)
@@ -0,0 +1,56 @@
+package machine
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// compactDetails drops the tombstones of fully removed machines from the
+// details store. An entry normally disappears when its removal goroutine
+// finishes, but under high churn the map can accumulate Removing entries
+// whose machine is already gone from the backend; compaction keeps the
+// map, and with it every iteration over it, bounded. The number of
+// dropped entries is returned
+func (m *machineProvider) compactDetails() (dropped int, err error) {
+	machines, err := m.listMachines()
+	if err != nil {
+		return 0, err
+	}
+
+	existing := make(map[string]struct{}, len(machines))
+	for _, name := range machines {
+		existing[name] = struct{}{}
+	}
+
+	m.machines().sweep(func(details *machineDetails) bool {
+		if details.State != machineStateRemoving {
+			return false
+		}
+		if _, ok := existing[details.Name]; ok {
+			// The backend still knows the machine: its removal is in
+			// flight and the goroutine will drop the entry itself
+			return false
+		}
+		dropped++
+		return true
+	})
+	return dropped, nil
+}
+
+// RunCompaction compacts the details store on a fixed tick until the
+// provider is closed
+func (m *machineProvider) RunCompaction() {
+	for {
+		select {
+		case <-m.done():
+			return
+		case <-time.After(compactionInterval):
+		}
+
+		if _, err := m.compactDetails(); err != nil {
+			logrus.WithError(err).
+				Warningln("Failed to compact the machine details store")
+		}
+	}
+}
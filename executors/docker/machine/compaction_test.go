@@ -0,0 +1,32 @@
+package machine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachineDetailsCompaction(t *testing.T) {
+	p, _ := testMachineProvider("machine1", "machine2")
+	p.machineDetails("machine1", false)
+
+	// Tombstones: marked for removal and already gone from the backend
+	for i := 0; i < 50; i++ {
+		details := p.machineDetails(fmt.Sprintf("gone-%d", i), false)
+		details.State = machineStateRemoving
+	}
+
+	// A removal that is still in flight: the backend still lists it
+	inFlight := p.machineDetails("machine2", false)
+	inFlight.State = machineStateRemoving
+
+	assert.Equal(t, 52, p.machines().len())
+
+	dropped, err := p.compactDetails()
+	assert.NoError(t, err)
+	assert.Equal(t, 50, dropped)
+	assert.Equal(t, 2, p.machines().len(), "live and in-flight machines should survive compaction")
+	assert.NotNil(t, p.machines().get("machine1"))
+	assert.NotNil(t, p.machines().get("machine2"))
+}
@@ -5,5 +5,52 @@ import "time"
 var provisionRetryInterval = time.Second
 var machineDeadInterval = 20 * time.Minute
 var removeRetryInterval = 30 * time.Second
+var removeRetryMaxInterval = 5 * time.Minute
 var removeRetryTries = 3
+var removeDeadLetterTries = 10
+var deadLetterSize = 100
 var machineStopCommandTimeout = 1 * time.Minute
+var maxConcurrentConnectProbes = 10
+var connectRetryInterval = time.Second
+var utilizationEWMAAlpha = 0.5
+var creationLatencyAlpha = 0.5
+var creationLatencySlowThreshold = time.Minute
+var maxLatencyIdleBoost = 3
+var lowUtilizationThreshold = 0.3
+var maxIdleTimeGrowth = 4
+var removalAuditSize = 100
+var decisionTraceSize = 100
+var recentBuildWindow = 20
+var certFreshnessMargin = 24 * time.Hour
+var machineDetailsShards = 32
+
+var listCacheTTL = time.Second
+
+var adoptionRetryInterval = 5 * time.Second
+var adoptionRetryTries = 3
+var adoptionConcurrency = 10
+
+var creationBreakerThreshold = 5
+var creationBreakerCooldown = time.Minute
+
+var creationHealthWindow = 20
+
+var machineEventBufferSize = 100
+var defaultScalingInterval = 10 * time.Second
+var defaultHeartbeatInterval = 30 * time.Second
+var machineAgeBuckets = []time.Duration{
+	15 * time.Minute,
+	time.Hour,
+	4 * time.Hour,
+	12 * time.Hour,
+}
+var defaultMaxQueueWait = 30 * time.Second
+var compactionInterval = 5 * time.Minute
+var peakDemandWindow = time.Hour
+var minMachineVersion = "0.14.0"
+var acquireWaitInterval = time.Second
+var defaultDrainDeadline = time.Minute
+var drainCheckInterval = time.Second
+var maxConcurrentCreates = 0
+var maxConcurrentRemoves = 0
+var maxConcurrentOperations = 0
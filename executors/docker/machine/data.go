@@ -16,6 +16,26 @@ type machinesData struct {
 	Used            int
 	Removing        int
 	StuckOnRemoving int
+	Standby         int
+	// Quarantined machines are kept alive for inspection only; they
+	// count neither as available nor toward the machine limit
+	Quarantined int
+
+	// Stopped machines are parked at the cloud's stopped-tier price:
+	// not idle, but still occupying a slot under the machine limit
+	Stopped int
+
+	// removed counts the machines this sweep sent to removal, by reason,
+	// for the scaling decision trace
+	removed map[string]int
+}
+
+// noteRemoval counts one removal decision of the current sweep
+func (d *machinesData) noteRemoval(reason string) {
+	if d.removed == nil {
+		d.removed = make(map[string]int)
+	}
+	d.removed[reason]++
 }
 
 func (d *machinesData) Available() int {
@@ -23,7 +43,7 @@ func (d *machinesData) Available() int {
 }
 
 func (d *machinesData) Total() int {
-	return d.Acquired + d.Creating + d.Idle + d.Used + d.Removing + d.StuckOnRemoving
+	return d.Acquired + d.Creating + d.Idle + d.Used + d.Removing + d.StuckOnRemoving + d.Stopped
 }
 
 func (d *machinesData) Add(details *machineDetails) {
@@ -46,6 +66,15 @@ func (d *machinesData) Add(details *machineDetails) {
 		} else {
 			d.Removing++
 		}
+
+	case machineStateStandby:
+		d.Standby++
+
+	case machineStateQuarantine:
+		d.Quarantined++
+
+	case machineStateStopped:
+		d.Stopped++
 	}
 }
 
@@ -57,6 +86,7 @@ func (d *machinesData) Fields() logrus.Fields {
 		"total":    d.Total(),
 		"creating": d.Creating,
 		"removing": d.Removing,
+		"standby":  d.Standby,
 	}
 }
 
@@ -0,0 +1,66 @@
+package machine
+
+import (
+	"sync"
+	"time"
+)
+
+// deadLetterEntry is a machine whose removal kept failing: the cloud
+// instance may well still exist and needs manual cleanup
+type deadLetterEntry struct {
+	Time      time.Time `json:"time"`
+	Name      string    `json:"name"`
+	Reason    string    `json:"reason"`
+	LastError string    `json:"last_error"`
+	Attempts  int       `json:"attempts"`
+}
+
+// deadLetterList collects the machines the provider gave up removing,
+// bounded like the removal audit, so that leaked instances surface in
+// the debug API instead of disappearing silently
+type deadLetterList struct {
+	lock    sync.Mutex
+	size    int
+	entries []deadLetterEntry
+}
+
+func newDeadLetterList(size int) *deadLetterList {
+	if size <= 0 {
+		size = deadLetterSize
+	}
+	return &deadLetterList{size: size}
+}
+
+func (l *deadLetterList) Add(details *machineDetails, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.entries = append(l.entries, deadLetterEntry{
+		Time:      time.Now(),
+		Name:      details.Name,
+		Reason:    details.Reason,
+		LastError: err.Error(),
+		Attempts:  details.RetryCount,
+	})
+	if len(l.entries) > l.size {
+		l.entries = l.entries[len(l.entries)-l.size:]
+	}
+}
+
+func (l *deadLetterList) Entries() []deadLetterEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entries := make([]deadLetterEntry, len(l.entries))
+	copy(entries, l.entries)
+	return entries
+}
+
+// DeadLetters returns a copy of the machines whose removal was given up
+// on, newest last
+func (m *machineProvider) DeadLetters() []deadLetterEntry {
+	if m.deadLetters == nil {
+		return nil
+	}
+	return m.deadLetters.Entries()
+}
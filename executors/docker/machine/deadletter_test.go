@@ -0,0 +1,55 @@
+package machine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMachineRemoveTransientRetry(t *testing.T) {
+	defer func(interval time.Duration) {
+		removeRetryInterval = interval
+	}(removeRetryInterval)
+	removeRetryInterval = 0
+
+	p, tm := testMachineProvider("remove-flaky")
+	p.machineDetails("remove-flaky", false)
+
+	err := p.remove("remove-flaky", "Too many builds")
+	assert.NoError(t, err)
+
+	<-tm.Removed
+	assertTotalMachines(t, p, 0, "the machine should be gone after the retry")
+	assert.Empty(t, p.DeadLetters(), "a removal that eventually succeeds is not dead-lettered")
+}
+
+func TestMachineRemoveDeadLetter(t *testing.T) {
+	defer func(interval time.Duration) {
+		removeRetryInterval = interval
+	}(removeRetryInterval)
+	removeRetryInterval = 0
+
+	p, _ := testMachineProvider("remove-fail")
+	p.machineDetails("remove-fail", false)
+
+	err := p.remove("remove-fail", "machine is unavailable")
+	assert.NoError(t, err)
+
+	var entries []deadLetterEntry
+	for i := 0; i < 100; i++ {
+		entries = p.DeadLetters()
+		if len(entries) > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	require.Len(t, entries, 1, "the machine should land in the dead-letter list")
+	assert.Equal(t, "remove-fail", entries[0].Name)
+	assert.Equal(t, "machine is unavailable", entries[0].Reason)
+	assert.Equal(t, "failed to remove", entries[0].LastError)
+	assert.Equal(t, removeDeadLetterTries, entries[0].Attempts)
+	assertTotalMachines(t, p, 0, "the machine should no longer be tracked")
+}
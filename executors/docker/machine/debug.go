@@ -0,0 +1,70 @@
+package machine
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// machineDebugInfo is a point-in-time snapshot of a single machine, in a
+// shape meant for human inspection rather than further processing
+type machineDebugInfo struct {
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	Reason    string `json:"reason,omitempty"`
+	Age       string `json:"age"`
+	UsedCount int    `json:"used_count"`
+	Attempts  int    `json:"attempts,omitempty"`
+	Driver    string `json:"driver,omitempty"`
+	Node      string `json:"node,omitempty"`
+	// LastError is the most recent driver error seen for the machine
+	LastError   string `json:"last_error,omitempty"`
+	LastErrorAt string `json:"last_error_at,omitempty"`
+}
+
+// poolDebugInfo bundles the machine snapshots with the pool totals and
+// the recent scaling decisions
+type poolDebugInfo struct {
+	Machines     []machineDebugInfo `json:"machines"`
+	Totals       machinesData       `json:"totals"`
+	ScalingTrace []scalingDecision  `json:"scaling_trace,omitempty"`
+	DeadLetters  []deadLetterEntry  `json:"dead_letters,omitempty"`
+}
+
+// DebugHandler returns a ready-to-mount http.Handler that renders the
+// current fleet as JSON: every machine with its state, reason, age and
+// used count, plus the pool totals. It only takes the per-shard read
+// locks for the duration of the snapshot, so it never blocks scaling
+func (m *machineProvider) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := poolDebugInfo{
+			Machines:     []machineDebugInfo{},
+			ScalingTrace: m.ScalingTrace(),
+			DeadLetters:  m.DeadLetters(),
+		}
+		m.machines().each(func(details *machineDetails) {
+			info.Totals.Add(details)
+			var lastErrorAt string
+			if !details.LastErrorAt.IsZero() {
+				lastErrorAt = details.LastErrorAt.Format(time.RFC3339)
+			}
+			info.Machines = append(info.Machines, machineDebugInfo{
+				Name:        details.Name,
+				State:       details.State.String(),
+				Reason:      details.Reason,
+				Age:         time.Since(details.Created).Round(time.Second).String(),
+				UsedCount:   details.UsedCount,
+				Attempts:    details.Attempts,
+				Driver:      details.Driver,
+				Node:        details.Node,
+				LastError:   details.LastError,
+				LastErrorAt: lastErrorAt,
+			})
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package machine
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMachineDebugHandler(t *testing.T) {
+	p := &machineProvider{}
+
+	idle := p.machineDetails("machine-idle", false)
+	used := p.machineDetails("machine-used", false)
+	used.State = machineStateUsed
+	used.UsedCount = 7
+	used.Reason = "running build"
+
+	rw := httptest.NewRecorder()
+	p.DebugHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+
+	var info poolDebugInfo
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &info))
+	require.Len(t, info.Machines, 2)
+
+	machines := make(map[string]machineDebugInfo, len(info.Machines))
+	for _, machine := range info.Machines {
+		machines[machine.Name] = machine
+	}
+	assert.Equal(t, idle.State.String(), machines["machine-idle"].State)
+	assert.Equal(t, "Used", machines["machine-used"].State)
+	assert.Equal(t, 7, machines["machine-used"].UsedCount)
+	assert.Equal(t, "running build", machines["machine-used"].Reason)
+
+	assert.Equal(t, 1, info.Totals.Idle)
+	assert.Equal(t, 1, info.Totals.Used)
+}
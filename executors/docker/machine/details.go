@@ -10,15 +10,92 @@ import (
 	"gitlab.com/gitlab-org/gitlab-runner/helpers"
 )
 
+// The provisioning phases a machine advances through while it is being
+// created; they pinpoint where a slow provisioning is stuck
+const (
+	machinePhaseCreate       = "create"
+	machinePhaseProvision    = "provision"
+	machinePhaseConnectCheck = "connect-check"
+	machinePhaseReady        = "ready"
+)
+
 type machineDetails struct {
-	Name       string
-	Created    time.Time `yaml:"-"`
-	Used       time.Time `yaml:"-"`
-	UsedCount  int
-	State      machineState
-	Reason     string
-	RetryCount int
-	LastSeen   time.Time
+	Name      string
+	Created   time.Time `yaml:"-"`
+	Used      time.Time `yaml:"-"`
+	UsedCount int
+	// UsedTime accumulates how long the machine has spent in the Used
+	// state over its whole lifetime
+	UsedTime time.Duration
+	State    machineState
+	// StateChanged is when the machine entered its current state; the
+	// per-state duration metrics are derived from it
+	StateChanged time.Time `yaml:"-"`
+	Reason       string
+	RetryCount   int
+	LastSeen     time.Time
+	Burst        bool
+	// Shape identifies the driver option overrides the machine was
+	// created with; it never changes after creation and an empty shape
+	// is the default one
+	Shape string
+	// Phase is the provisioning phase the machine is currently in
+	Phase string
+	// ProvisionStarted is when the machine actually started provisioning,
+	// i.e. after it left the creation queue; it stays zero while queued
+	ProvisionStarted time.Time `yaml:"-"`
+	// LastProject is the affinity key of the last job that ran on the
+	// machine, used to keep a project's builds on its warm caches
+	LastProject string
+	// ActiveBuilds counts the builds currently running on the machine;
+	// with MaxConcurrentBuilds > 1 several builds share one machine
+	ActiveBuilds int
+	// CooldownUntil keeps the machine idle-but-unselectable until the
+	// given time, letting it settle down after a released build
+	CooldownUntil time.Time `yaml:"-"`
+	// Reserved pins the machine in the pool permanently: scaling sweeps
+	// and lifetime rotation skip it and it always returns to idle
+	Reserved bool
+	// CredentialFailures counts consecutive Credentials errors on an
+	// otherwise reachable machine; any successful fetch resets it
+	CredentialFailures int
+	// Attempts counts every Create and Provision call made while
+	// bringing the machine up, making flaky provisioning visible
+	Attempts int
+	// FailedBuilds counts the consecutive builds that failed on the
+	// machine; the first successful build clears it
+	FailedBuilds int
+	// LastError keeps the most recent error any driver call for this
+	// machine produced, with the time it happened, so that a flapping
+	// host can be diagnosed without log spelunking
+	LastError   string
+	LastErrorAt time.Time `yaml:"-"`
+	// Adopted marks a machine inherited from a previous runner
+	// generation rather than created by this process; free-machine
+	// selection softly prefers its own machines, so the adopted ones
+	// drain naturally
+	Adopted bool
+	// BoundJob is the job ID the machine is currently reserved for, so
+	// that a retried acquire of the same job finds it again; zero means
+	// no binding
+	BoundJob int64 `yaml:"-"`
+	// Driver is the backend driver the machine was created with; for
+	// adopted machines it is asked from the backend when available
+	Driver string
+	// RunnerVersion is the version of the runner binary that created the
+	// machine; after an upgrade it singles out the old fleet for draining
+	RunnerVersion string
+	// ImageGeneration is the base image generation the machine was
+	// provisioned with; after a generation bump the sweep recycles the
+	// idle machines still carrying an old one
+	ImageGeneration string
+	// Node is the docker endpoint the machine answers on, captured from
+	// its credentials; it tells operators where the machine landed
+	Node string
+
+	// clients caches the Docker client the machine's builds share; it is
+	// dropped when the machine is removed or its credentials change
+	clients *dockerClientCache
 }
 
 func (m *machineDetails) isUsed() bool {
@@ -34,8 +111,33 @@ func (m *machineDetails) isDead() bool {
 		time.Since(m.LastSeen) > machineDeadInterval
 }
 
+// stuckCreating tells whether the machine has spent longer than the
+// given number of seconds actually provisioning. Time spent waiting in
+// the creation queue doesn't count
+func (m *machineDetails) stuckCreating(creationTimeout int) bool {
+	if creationTimeout <= 0 || m.State != machineStateCreating || m.ProvisionStarted.IsZero() {
+		return false
+	}
+	return time.Since(m.ProvisionStarted) > time.Second*time.Duration(creationTimeout)
+}
+
+// usedDuration returns the cumulative time the machine has spent running
+// builds, including the build it may be running right now
+func (m *machineDetails) usedDuration() time.Duration {
+	used := m.UsedTime
+	if m.State == machineStateUsed {
+		used += time.Since(m.Used)
+	}
+	return used
+}
+
+func (m *machineDetails) usedTooLong(maxUseTime int) bool {
+	return maxUseTime > 0 &&
+		m.UsedTime >= time.Second*time.Duration(maxUseTime)
+}
+
 func (m *machineDetails) canBeUsed() bool {
-	return m.State == machineStateAcquired
+	return m.State == machineStateAcquired || m.State == machineStateUsed
 }
 
 func (m *machineDetails) match(machineFilter string) bool {
@@ -0,0 +1,111 @@
+package machine
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// detailsShard is a single bucket of the sharded details store. Each
+// shard guards its own slice of the machines with a separate lock
+type detailsShard struct {
+	lock    sync.RWMutex
+	details machinesDetails
+}
+
+// detailsStore keeps the tracked machine details sharded by a hash of
+// the machine name. A single RWMutex around one big map serializes every
+// acquire and release once the fleet grows to thousands of machines;
+// per-shard locks let operations on different machines proceed without
+// contending
+type detailsStore struct {
+	shards []*detailsShard
+}
+
+func newDetailsStore(shardCount int) *detailsStore {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+
+	store := &detailsStore{
+		shards: make([]*detailsShard, shardCount),
+	}
+	for i := range store.shards {
+		store.shards[i] = &detailsShard{
+			details: make(machinesDetails),
+		}
+	}
+	return store
+}
+
+func (s *detailsStore) shard(name string) *detailsShard {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name))
+	return s.shards[hash.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *detailsStore) get(name string) *machineDetails {
+	shard := s.shard(name)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	return shard.details[name]
+}
+
+func (s *detailsStore) remove(name string) {
+	shard := s.shard(name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	delete(shard.details, name)
+}
+
+// rename re-keys the given machine under a fresh name, moving it to the
+// shard that name hashes to
+func (s *detailsStore) rename(details *machineDetails, newName string) {
+	oldShard := s.shard(details.Name)
+	oldShard.lock.Lock()
+	delete(oldShard.details, details.Name)
+	oldShard.lock.Unlock()
+
+	details.Name = newName
+
+	newShard := s.shard(newName)
+	newShard.lock.Lock()
+	newShard.details[newName] = details
+	newShard.lock.Unlock()
+}
+
+func (s *detailsStore) len() (count int) {
+	for _, shard := range s.shards {
+		shard.lock.RLock()
+		count += len(shard.details)
+		shard.lock.RUnlock()
+	}
+	return
+}
+
+// each calls fn for every tracked machine, holding only the lock of the
+// shard that is currently visited
+func (s *detailsStore) each(fn func(details *machineDetails)) {
+	for _, shard := range s.shards {
+		shard.lock.RLock()
+		for _, details := range shard.details {
+			fn(details)
+		}
+		shard.lock.RUnlock()
+	}
+}
+
+// sweep calls fn for every tracked machine and drops the entries for
+// which fn returns true
+func (s *detailsStore) sweep(fn func(details *machineDetails) bool) {
+	for _, shard := range s.shards {
+		shard.lock.Lock()
+		for name, details := range shard.details {
+			if fn(details) {
+				delete(shard.details, name)
+			}
+		}
+		shard.lock.Unlock()
+	}
+}
@@ -0,0 +1,148 @@
+package machine
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+)
+
+func (m *machineProvider) setDraining(draining bool) {
+	m.drainLock.Lock()
+	defer m.drainLock.Unlock()
+	m.draining = draining
+}
+
+func (m *machineProvider) isDraining() bool {
+	m.drainLock.Lock()
+	defer m.drainLock.Unlock()
+	return m.draining
+}
+
+func (m *machineProvider) setTeardownOrder(order string) {
+	m.drainLock.Lock()
+	defer m.drainLock.Unlock()
+	m.teardownOrder = order
+}
+
+func (m *machineProvider) getTeardownOrder() string {
+	m.drainLock.Lock()
+	defer m.drainLock.Unlock()
+	return m.teardownOrder
+}
+
+// cordonFreeMachines sends all idle and standby machines to removal
+func (m *machineProvider) cordonFreeMachines() {
+	var free []string
+	m.machines().each(func(details *machineDetails) {
+		if details.State == machineStateIdle || details.State == machineStateStandby {
+			free = append(free, details.Name)
+		}
+	})
+
+	for _, name := range free {
+		m.remove(name, "Draining pool")
+	}
+}
+
+func (m *machineProvider) countBusyMachines() (busy int) {
+	m.machines().each(func(details *machineDetails) {
+		switch details.State {
+		case machineStateUsed, machineStateAcquired, machineStateCreating:
+			busy++
+		}
+	})
+	return
+}
+
+// Drain gracefully shrinks the pool: machine creation stops, free
+// machines are cordoned for removal and machines still running builds
+// get up to deadline to finish. With forceRemove set, machines that
+// overstay the deadline are removed anyway
+func (m *machineProvider) Drain(deadline time.Duration, forceRemove bool) {
+	m.setDraining(true)
+
+	// With the busy-first teardown order the idle machines stay in
+	// place until every build is done, so the cloud sees an orderly
+	// busy-then-idle removal sequence instead of an interleaved one
+	busyFirst := m.getTeardownOrder() == "busy-first"
+	defer logrus.WithField("name", m.name).
+		Infoln("Pool teardown finished")
+
+	if deadline <= 0 {
+		deadline = defaultDrainDeadline
+	}
+	deadlineCh := time.After(deadline)
+
+	for {
+		// Re-cordon on every pass, so machines released while the drain
+		// is waiting are removed as well
+		if !busyFirst {
+			m.cordonFreeMachines()
+		}
+
+		if m.countBusyMachines() == 0 {
+			if busyFirst {
+				m.cordonFreeMachines()
+			}
+			return
+		}
+
+		select {
+		case <-m.done():
+			// The provider is being closed; stop waiting for the builds
+			return
+		case <-deadlineCh:
+			if forceRemove {
+				var busy []string
+				m.machines().each(func(details *machineDetails) {
+					switch details.State {
+					case machineStateUsed, machineStateAcquired, machineStateCreating:
+						busy = append(busy, details.Name)
+					}
+				})
+				for _, name := range busy {
+					m.remove(name, "Drain deadline exceeded")
+				}
+			}
+			if busyFirst {
+				m.cordonFreeMachines()
+			}
+			return
+		case <-time.After(drainCheckInterval):
+		}
+	}
+}
+
+// DrainOnSignal arranges for the pool to be drained when one of the
+// given signals (SIGTERM by default) arrives, using the shutdown
+// deadline and force behavior from the runner configuration
+func (m *machineProvider) DrainOnSignal(config *common.RunnerConfig, signals ...os.Signal) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+
+	go func() {
+		select {
+		case <-ch:
+		case <-m.done():
+			signal.Stop(ch)
+			return
+		}
+
+		var deadline time.Duration
+		var forceRemove bool
+		if config != nil && config.Machine != nil {
+			deadline = time.Duration(config.Machine.ShutdownTimeout) * time.Second
+			forceRemove = config.Machine.ShutdownForceRemove
+		}
+		m.Drain(deadline, forceRemove)
+	}()
+}
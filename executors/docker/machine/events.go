@@ -0,0 +1,60 @@
+package machine
+
+import "time"
+
+// MachineEventType names a machine lifecycle transition
+type MachineEventType string
+
+const (
+	MachineEventCreated  MachineEventType = "created"
+	MachineEventAcquired MachineEventType = "acquired"
+	MachineEventReleased MachineEventType = "released"
+	MachineEventRemoved  MachineEventType = "removed"
+)
+
+// MachineEvent describes a single machine lifecycle transition; external
+// consumers can stream them through machineProvider.Events to drive
+// dashboards
+type MachineEvent struct {
+	Type    MachineEventType
+	Machine string
+	Reason  string
+	Time    time.Time
+}
+
+// Events returns a buffered channel streaming the machine lifecycle
+// events. Events are dropped when the consumer falls behind, so that
+// emitting them never stalls scaling
+func (m *machineProvider) Events() <-chan MachineEvent {
+	m.eventsLock.Lock()
+	defer m.eventsLock.Unlock()
+
+	if m.events == nil {
+		m.events = make(chan MachineEvent, machineEventBufferSize)
+	}
+	return m.events
+}
+
+func (m *machineProvider) emitEvent(eventType MachineEventType, machineName, reason string) {
+	m.eventsLock.Lock()
+	events := m.events
+	m.eventsLock.Unlock()
+
+	// Without a subscriber there is nothing to stream to
+	if events == nil {
+		return
+	}
+
+	event := MachineEvent{
+		Type:    eventType,
+		Machine: machineName,
+		Reason:  reason,
+		Time:    time.Now(),
+	}
+
+	select {
+	case events <- event:
+	default:
+		// Drop the event instead of stalling the provider
+	}
+}
@@ -63,9 +63,12 @@ func (e *machineExecutor) Prepare(options common.ExecutorPrepareOptions) (err er
 		options.Config.Docker = &common.DockerConfig{}
 	}
 
-	// Use the machine
+	// Use the machine, applying the shape overrides and the project
+	// affinity the job may request
 	e.SetCurrentStage(DockerMachineExecutorStageUseMachine)
-	e.config, e.data, err = e.provider.Use(options.Config, options.Build.ExecutorData)
+	config := applyMachineShape(options.Config, options.Build.GetAllVariables())
+	config = applyProjectAffinity(config, options.Build)
+	e.config, e.data, err = e.provider.Use(config, options.Build.ExecutorData)
 	if err != nil {
 		return err
 	}
@@ -101,6 +104,14 @@ func (e *machineExecutor) Finish(err error) {
 	if e.executor != nil {
 		e.executor.Finish(err)
 	}
+
+	// Feed the build outcome back into the machine failure policy
+	data := e.build.ExecutorData
+	if data == nil {
+		data = e.data
+	}
+	e.provider.ReportBuildResult(data, err == nil)
+
 	e.log().Infoln("Finished docker-machine build:", err)
 }
 
@@ -0,0 +1,180 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+)
+
+// flavorShape returns the shape identifying machines of the given flavor
+func flavorShape(flavor *common.DockerMachineFlavor) string {
+	return "flavor:" + flavor.Name
+}
+
+// findFlavor returns the flavor the given shape belongs to, or nil for
+// the main pool and for job-override shapes
+func findFlavor(config *common.RunnerConfig, shape string) *common.DockerMachineFlavor {
+	if config.Machine == nil {
+		return nil
+	}
+
+	for _, flavor := range config.Machine.MachineFlavors {
+		if flavorShape(flavor) == shape {
+			return flavor
+		}
+	}
+	return nil
+}
+
+// findFlavorByName returns the configured flavor of the given name, or
+// nil when no such flavor exists
+func findFlavorByName(config *common.RunnerConfig, name string) *common.DockerMachineFlavor {
+	if config.Machine == nil {
+		return nil
+	}
+
+	for _, flavor := range config.Machine.MachineFlavors {
+		if flavor.Name == name {
+			return flavor
+		}
+	}
+	return nil
+}
+
+// flavorConfig returns a copy of config that creates machines of the
+// given flavor
+func flavorConfig(config *common.RunnerConfig, flavor *common.DockerMachineFlavor) *common.RunnerConfig {
+	newConfig := *config
+	machine := *config.Machine
+	newConfig.Machine = &machine
+
+	machine.MachineShape = flavorShape(flavor)
+	if len(flavor.MachineOptions) > 0 {
+		machine.MachineOptions = append(append([]string(nil), machine.MachineOptions...), flavor.MachineOptions...)
+	}
+	machine.IdleCount = flavor.IdleCount
+	machine.IdleTime = flavor.IdleTime
+	return &newConfig
+}
+
+func (m *machineProvider) countFlavorAvailable(flavor *common.DockerMachineFlavor) (count int) {
+	shape := flavorShape(flavor)
+	m.machines().each(func(details *machineDetails) {
+		if details.Shape != shape {
+			return
+		}
+		switch details.State {
+		case machineStateIdle, machineStateCreating:
+			count++
+		}
+	})
+	return
+}
+
+func (m *machineProvider) countFlavorIdle(flavor *common.DockerMachineFlavor) (count int) {
+	shape := flavorShape(flavor)
+	m.machines().each(func(details *machineDetails) {
+		if details.Shape == shape && details.State == machineStateIdle {
+			count++
+		}
+	})
+	return
+}
+
+// checkFlavorLimit enforces a flavor's own Limit on top of the global
+// caps, so a scarce flavor stays at its handful of machines while the
+// other pools keep scaling under MaxTotalMachines
+func (m *machineProvider) checkFlavorLimit(config *common.RunnerConfig) error {
+	flavor := findFlavor(config, machineShape(config))
+	if flavor == nil || flavor.Limit <= 0 {
+		return nil
+	}
+
+	shape := flavorShape(flavor)
+	total := 0
+	m.machines().each(func(details *machineDetails) {
+		if details.Shape == shape && details.State != machineStateRemoving {
+			total++
+		}
+	})
+
+	if total >= flavor.Limit {
+		return fmt.Errorf("machine limit of %d for flavor %q reached", flavor.Limit, flavor.Name)
+	}
+	return nil
+}
+
+// useFallbackFlavor walks the fallback chain of the flavor that just
+// failed to hand out a machine, e.g. from exhausted spot capacity over
+// to on-demand instances. Only the direct chain of the requested flavor
+// is walked; the fallbacks' own chains are not followed, which also
+// rules out cycles
+func (m *machineProvider) useFallbackFlavor(config *common.RunnerConfig, deadline time.Time, primaryErr error) (*machineDetails, error) {
+	flavor := findFlavor(config, machineShape(config))
+	if flavor == nil || len(flavor.FlavorFallback) == 0 {
+		return nil, primaryErr
+	}
+
+	// The incoming config carries the primary flavor's machine options as
+	// a suffix (see flavorConfig); strip them so the alternate flavor
+	// doesn't inherit them
+	base := *config
+	machine := *config.Machine
+	base.Machine = &machine
+	if n := len(flavor.MachineOptions); n > 0 && len(machine.MachineOptions) >= n {
+		machine.MachineOptions = machine.MachineOptions[:len(machine.MachineOptions)-n]
+	}
+
+	for _, name := range flavor.FlavorFallback {
+		alternate := findFlavorByName(&base, name)
+		if alternate == nil || alternate == flavor {
+			continue
+		}
+
+		logrus.WithField("flavor", flavor.Name).
+			WithField("fallback", alternate.Name).
+			WithError(primaryErr).
+			Infoln("Falling back to an alternate machine flavor")
+
+		details, err := m.useShapeMachine(flavorConfig(&base, alternate), deadline)
+		if err == nil {
+			return details, nil
+		}
+		if err == errAcquireTimedOut {
+			return nil, err
+		}
+	}
+	return nil, primaryErr
+}
+
+// createFlavorMachines fills each flavor up to its own idle target,
+// independently of the main pool
+func (m *machineProvider) createFlavorMachines(config *common.RunnerConfig) {
+	for _, flavor := range config.Machine.MachineFlavors {
+		// A flavor with its own Limit never warms up beyond it
+		target := flavor.IdleCount
+		if flavor.Limit > 0 && flavor.Limit < target {
+			target = flavor.Limit
+		}
+		for available := m.countFlavorAvailable(flavor); available < target; available++ {
+			if details, _ := m.create(flavorConfig(config, flavor), machineStateIdle); details == nil {
+				return
+			}
+		}
+	}
+}
+
+// updateFlavorMachine evaluates an idle flavored machine against its own
+// flavor targets instead of the main pool ones
+func (m *machineProvider) updateFlavorMachine(flavor *common.DockerMachineFlavor, details *machineDetails) error {
+	if time.Since(details.Used) > time.Second*time.Duration(flavor.IdleTime) {
+		if m.countFlavorIdle(flavor) > flavor.IdleCount {
+			return errors.New("Too many idle machines")
+		}
+	}
+	return nil
+}
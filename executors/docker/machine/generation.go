@@ -0,0 +1,19 @@
+package machine
+
+// SetImageGeneration tells the provider which CI base image generation
+// (a tag or digest) machines are currently provisioned with. New
+// machines are stamped with it and the scaling sweep recycles the idle
+// machines that carry an older one, so that a base image update doesn't
+// keep serving builds from stale caches. Machines running builds are
+// left to finish and are recycled once they come back idle
+func (m *machineProvider) SetImageGeneration(generation string) {
+	m.imageGenLock.Lock()
+	defer m.imageGenLock.Unlock()
+	m.imageGeneration = generation
+}
+
+func (m *machineProvider) getImageGeneration() string {
+	m.imageGenLock.Lock()
+	defer m.imageGenLock.Unlock()
+	return m.imageGeneration
+}
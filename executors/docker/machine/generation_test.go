@@ -0,0 +1,41 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachineImageGenerationRecycle(t *testing.T) {
+	p, _ := testMachineProvider()
+	p.SetImageGeneration("v1")
+
+	config := createMachineConfig(1, 5)
+	p.Acquire(config)
+	assertIdleMachines(t, p, 1)
+
+	data, err := p.Acquire(config)
+	assert.NoError(t, err)
+	d := data.(*machineDetails)
+	assert.Equal(t, "v1", d.ImageGeneration, "created machines carry the current generation")
+	d.State = machineStateUsed
+
+	// Bump the generation while the machine runs a build: the sweep
+	// must leave it alone and refill the pool with fresh machines
+	p.SetImageGeneration("v2")
+	p.Acquire(config)
+	assert.True(t, d.canBeUsed(), "a used machine survives the generation bump")
+	assertIdleMachines(t, p, 1)
+	p.machines().each(func(details *machineDetails) {
+		if details.State == machineStateIdle {
+			assert.Equal(t, "v2", details.ImageGeneration, "the replacement machines carry the new generation")
+		}
+	})
+
+	// Once released, the stale machine is recycled by the next sweep
+	p.Release(config, d)
+	_, valid := p.updateMachines([]string{d.Name}, config)
+	assert.NotContains(t, valid, d.Name)
+	assert.Equal(t, machineStateRemoving, d.State)
+	assert.Equal(t, "Stale image generation", d.Reason)
+}
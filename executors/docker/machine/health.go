@@ -0,0 +1,56 @@
+package machine
+
+import (
+	"sync"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+)
+
+// creationHealth keeps a rolling window of the most recent create
+// outcomes and derives a success rate from it. Unlike the creation
+// breaker it never blocks anything: it exists so that monitoring can
+// page when provisioning fails often without failing consecutively
+type creationHealth struct {
+	lock     sync.Mutex
+	outcomes []bool
+}
+
+func (h *creationHealth) record(success bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.outcomes = append(h.outcomes, success)
+	if len(h.outcomes) > creationHealthWindow {
+		h.outcomes = h.outcomes[len(h.outcomes)-creationHealthWindow:]
+	}
+}
+
+// successRate returns the share of successful creates in the window as
+// a percentage; an empty window counts as fully healthy
+func (h *creationHealth) successRate() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.outcomes) == 0 {
+		return 100
+	}
+
+	successes := 0
+	for _, success := range h.outcomes {
+		if success {
+			successes++
+		}
+	}
+	return successes * 100 / len(h.outcomes)
+}
+
+// Healthy reports whether the recent machine creations meet the
+// configured minimum success rate; with no threshold configured the
+// provider always counts as healthy
+func (m *machineProvider) Healthy(config *common.RunnerConfig) bool {
+	threshold := config.Machine.MinCreationSuccessRate
+	if threshold <= 0 {
+		return true
+	}
+	return m.creationHealth.successRate() >= threshold
+}
@@ -0,0 +1,40 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachineCreationHealthSignal(t *testing.T) {
+	p := &machineProvider{}
+	config := createMachineConfig(0, 0)
+	config.Machine.MinCreationSuccessRate = 50
+
+	assert.True(t, p.Healthy(config), "an empty window should count as healthy")
+
+	for i := 0; i < 10; i++ {
+		p.creationHealth.record(true)
+	}
+	for i := 0; i < 9; i++ {
+		p.creationHealth.record(false)
+	}
+	assert.True(t, p.Healthy(config))
+
+	// one more failure fills the window: 10/20 sits right at the threshold
+	p.creationHealth.record(false)
+	assert.True(t, p.Healthy(config))
+
+	// the oldest success slides out of the window: 9/20 is below it
+	p.creationHealth.record(false)
+	assert.False(t, p.Healthy(config), "the signal should flip below the threshold")
+
+	// a streak of successes pushes the failures out again
+	for i := 0; i < 12; i++ {
+		p.creationHealth.record(true)
+	}
+	assert.True(t, p.Healthy(config))
+
+	config.Machine.MinCreationSuccessRate = 0
+	assert.True(t, p.Healthy(config), "no threshold means always healthy")
+}
@@ -0,0 +1,120 @@
+package machine
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+)
+
+// heartbeatInterval returns the delay between two heartbeat sweeps,
+// falling back to the default when not configured
+func heartbeatInterval(config *common.RunnerConfig) time.Duration {
+	interval := time.Duration(config.Machine.HeartbeatInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+	return interval
+}
+
+// heartbeatConcurrency bounds how many CanConnect probes a sweep runs at
+// once, sharing the default with the acquire-path probes
+func heartbeatConcurrency(config *common.RunnerConfig) int {
+	concurrency := config.Machine.HeartbeatConcurrency
+	if concurrency <= 0 {
+		concurrency = maxConcurrentConnectProbes
+	}
+	return concurrency
+}
+
+// heartbeatSweep probes every idle machine and takes the ones that
+// stopped answering out of the pool, then refills it. Idle machines can
+// die silently (e.g. spot reclamation) and without the sweep the next
+// job would pay for discovering that at acquire time
+func (m *machineProvider) heartbeatSweep(config *common.RunnerConfig) {
+	var idle []string
+	m.machines().each(func(details *machineDetails) {
+		if details.State == machineStateIdle {
+			idle = append(idle, details.Name)
+		}
+	})
+
+	var wg sync.WaitGroup
+	probes := make(chan struct{}, heartbeatConcurrency(config))
+	for _, name := range idle {
+		wg.Add(1)
+		probes <- struct{}{}
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-probes }()
+
+			if m.canConnect(name, true) {
+				return
+			}
+			// The machine may have been handed to a build while we
+			// probed; only still-idle machines are failed
+			if details := m.machines().get(name); details == nil || details.State != machineStateIdle {
+				return
+			}
+			m.failMachine(name, "Heartbeat failed")
+		}(name)
+	}
+	wg.Wait()
+
+	// Refill the pool for the machines the sweep took out
+	machines, err := m.loadMachines(config)
+	if err != nil {
+		return
+	}
+	data, _ := m.updateMachines(machines, config)
+	m.createMachines(config, &data)
+}
+
+// CheckHealth probes one machine on demand, without waiting for the
+// next heartbeat tick: the plain connectivity check first, then the
+// credential fetch that real builds depend on. The outcome is recorded
+// on the machine details just like the acquire path would, so that the
+// debug API reflects the probe
+func (m *machineProvider) CheckHealth(name string) (bool, error) {
+	details := m.machines().get(name)
+	if details == nil {
+		return false, errors.New("Machine not found")
+	}
+
+	if !m.canConnect(name, true) {
+		err := errors.New("machine is unavailable")
+		m.recordMachineError(name, err)
+		return false, err
+	}
+
+	err := m.guardDriverCall(name, func() error {
+		dc, err := m.machine.Credentials(name)
+		if err != nil {
+			return err
+		}
+		if err = validateCredentials(dc); err != nil {
+			return err
+		}
+		details.Node = dc.Host
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RunHeartbeat probes the idle machines on a fixed tick until the
+// provider is closed. It complements the scaling loop: the loop keeps
+// the pool at its size targets, the heartbeat keeps it reachable
+func (m *machineProvider) RunHeartbeat(config *common.RunnerConfig) {
+	for {
+		select {
+		case <-m.done():
+			return
+		case <-time.After(heartbeatInterval(config)):
+		}
+		m.heartbeatSweep(config)
+	}
+}
@@ -0,0 +1,65 @@
+package machine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeatDefaults(t *testing.T) {
+	config := createMachineConfig(0, 5)
+	assert.Equal(t, defaultHeartbeatInterval, heartbeatInterval(config))
+	assert.Equal(t, maxConcurrentConnectProbes, heartbeatConcurrency(config))
+
+	config.Machine.HeartbeatInterval = 7
+	config.Machine.HeartbeatConcurrency = 2
+	assert.Equal(t, 7*time.Second, heartbeatInterval(config))
+	assert.Equal(t, 2, heartbeatConcurrency(config))
+}
+
+func TestMachineCheckHealth(t *testing.T) {
+	p, _ := testMachineProvider("machine1", "no-can-connect-1")
+	p.machineDetails("machine1", false)
+	p.machineDetails("no-can-connect-1", false)
+
+	healthy, err := p.CheckHealth("machine1")
+	assert.True(t, healthy)
+	assert.NoError(t, err)
+	details := p.machines().get("machine1")
+	assert.Empty(t, details.LastError)
+	assert.Equal(t, "tcp://machine1:2376", details.Node, "a successful check should capture the node address")
+
+	healthy, err = p.CheckHealth("no-can-connect-1")
+	assert.False(t, healthy)
+	assert.Error(t, err)
+	details = p.machines().get("no-can-connect-1")
+	assert.Equal(t, "machine is unavailable", details.LastError)
+	assert.False(t, details.LastErrorAt.IsZero())
+
+	_, err = p.CheckHealth("unknown")
+	assert.Error(t, err, "an untracked machine should be reported")
+}
+
+func TestMachineHeartbeat(t *testing.T) {
+	p, tm := testMachineProvider()
+	config := createMachineConfig(1, 5)
+
+	p.Acquire(config)
+	assertIdleMachines(t, p, 1)
+
+	var victim string
+	p.machines().each(func(details *machineDetails) {
+		if details.State == machineStateIdle {
+			victim = details.Name
+		}
+	})
+	tm.markBroken(victim)
+
+	p.heartbeatSweep(config)
+
+	assertIdleMachines(t, p, 1, "the heartbeat should replace the unreachable machine")
+	if details := p.machines().get(victim); details != nil {
+		assert.NotEqual(t, machineStateIdle, details.State, "the unreachable machine must not come back as idle")
+	}
+}
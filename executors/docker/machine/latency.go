@@ -0,0 +1,43 @@
+package machine
+
+import "time"
+
+// recordCreationLatency folds the duration of a successful create into
+// the smoothed latency, giving recent creates more weight
+func (m *machineProvider) recordCreationLatency(d time.Duration) {
+	m.creationLatencyLock.Lock()
+	defer m.creationLatencyLock.Unlock()
+
+	if m.creationLatencyEWMA == 0 {
+		m.creationLatencyEWMA = d
+		return
+	}
+	m.creationLatencyEWMA = time.Duration(
+		creationLatencyAlpha*float64(d) +
+			(1-creationLatencyAlpha)*float64(m.creationLatencyEWMA))
+}
+
+func (m *machineProvider) creationLatency() time.Duration {
+	m.creationLatencyLock.Lock()
+	defer m.creationLatencyLock.Unlock()
+
+	return m.creationLatencyEWMA
+}
+
+// latencyIdleBoost translates slow creates into extra idle machines:
+// one for every full creationLatencySlowThreshold of the smoothed
+// create duration, capped at maxLatencyIdleBoost. While the cloud needs
+// minutes to provision a machine, jobs keep finding warm ones; once
+// creates are fast again the boost drops away on its own
+func (m *machineProvider) latencyIdleBoost() int {
+	latency := m.creationLatency()
+	if latency < creationLatencySlowThreshold {
+		return 0
+	}
+
+	boost := int(latency / creationLatencySlowThreshold)
+	if boost > maxLatencyIdleBoost {
+		boost = maxLatencyIdleBoost
+	}
+	return boost
+}
@@ -0,0 +1,30 @@
+package machine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachineCreationLatencyAdjustsIdleTarget(t *testing.T) {
+	p, _ := testMachineProvider()
+	config := createMachineConfig(2, 5)
+
+	assert.Equal(t, 2, p.idleCount(config), "without latency data the configured target applies")
+
+	// A cloud taking minutes per create earns the pool the full boost
+	p.recordCreationLatency(5 * time.Minute)
+	assert.Equal(t, 2+maxLatencyIdleBoost, p.idleCount(config))
+
+	// A streak of fast creates pulls the average back down
+	for i := 0; i < 12; i++ {
+		p.recordCreationLatency(time.Second)
+	}
+	assert.Equal(t, 2, p.idleCount(config))
+
+	// A pool that aims for zero idle is never inflated by slow creates
+	p.recordCreationLatency(10 * time.Minute)
+	config = createMachineConfig(0, 0)
+	assert.Equal(t, 0, p.idleCount(config))
+}
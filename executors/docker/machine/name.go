@@ -39,9 +39,35 @@ func filterMachineList(machines []string, filter string) (newMachines []string)
 	return
 }
 
+// nameSuffixCharset is used for the suffixes of clouds that only accept
+// letters and digits in instance names
+const nameSuffixCharset = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+func randomSuffix(length int) string {
+	r := make([]byte, length)
+	rand.Read(r)
+	for i := range r {
+		r[i] = nameSuffixCharset[int(r[i])%len(nameSuffixCharset)]
+	}
+	return string(r)
+}
+
 func newMachineName(config *common.RunnerConfig) string {
+	machine := config.Machine
+
+	// A configured suffix length drops the timestamp: clouds with short
+	// name limits get names of a predictable length, at the price of
+	// the newest-first name ordering
+	if machine.NameSuffixLength > 0 {
+		return fmt.Sprintf(machineFilter(config), randomSuffix(machine.NameSuffixLength))
+	}
+
+	t := time.Now().Unix()
+	if machine.NameAlphanumericOnly {
+		return fmt.Sprintf(machineFilter(config), fmt.Sprintf("%d%s", t, randomSuffix(8)))
+	}
+
 	r := make([]byte, 4)
 	rand.Read(r)
-	t := time.Now().Unix()
 	return fmt.Sprintf(machineFilter(config), fmt.Sprintf("%d-%x", t, r))
 }
@@ -1,6 +1,7 @@
 package machine
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -40,6 +41,30 @@ func TestNewMachineName(t *testing.T) {
 	}
 }
 
+func TestNewMachineNameSuffixOptions(t *testing.T) {
+	config := &common.RunnerConfig{
+		RunnerSettings: common.RunnerSettings{
+			Machine: &common.DockerMachine{
+				MachineName:      "test-machine-%s",
+				NameSuffixLength: 6,
+			},
+		},
+	}
+
+	name := newMachineName(config)
+	assert.Len(t, name, len("test-machine-")+6)
+	for _, c := range strings.TrimPrefix(name, "test-machine-") {
+		assert.Contains(t, nameSuffixCharset, string(c))
+	}
+
+	config.Machine.NameSuffixLength = 0
+	config.Machine.NameAlphanumericOnly = true
+	name = newMachineName(config)
+	suffix := strings.TrimPrefix(name, "test-machine-")
+	assert.NotEmpty(t, suffix)
+	assert.NotContains(t, suffix, "-", "the alphanumeric-only suffix must not contain a separator")
+}
+
 func TestNewMachineNameIsUnique(t *testing.T) {
 	config := &common.RunnerConfig{
 		RunnerSettings: common.RunnerSettings{
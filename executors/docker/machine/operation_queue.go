@@ -0,0 +1,69 @@
+package machine
+
+import "sync"
+
+// operationQueue bounds concurrent machine operations and lets urgent
+// requests, for which a build is already waiting, jump ahead of the
+// background work
+type operationQueue struct {
+	lock       sync.Mutex
+	slots      int
+	running    int
+	urgent     []chan struct{}
+	background []chan struct{}
+}
+
+// newOperationQueue returns a queue running up to slots operations at
+// once; a non-positive slots value means no limit
+func newOperationQueue(slots int) *operationQueue {
+	return &operationQueue{slots: slots}
+}
+
+func (q *operationQueue) setSlots(slots int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.slots = slots
+}
+
+func (q *operationQueue) acquire(urgent bool) {
+	q.lock.Lock()
+	if q.slots <= 0 || q.running < q.slots {
+		q.running++
+		q.lock.Unlock()
+		return
+	}
+
+	wait := make(chan struct{})
+	if urgent {
+		q.urgent = append(q.urgent, wait)
+	} else {
+		q.background = append(q.background, wait)
+	}
+	q.lock.Unlock()
+
+	<-wait
+}
+
+func (q *operationQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.running--
+
+	var next chan struct{}
+	if len(q.urgent) > 0 {
+		next, q.urgent = q.urgent[0], q.urgent[1:]
+	} else if len(q.background) > 0 {
+		next, q.background = q.background[0], q.background[1:]
+	}
+	if next != nil {
+		q.running++
+		close(next)
+	}
+}
+
+func (q *operationQueue) waiting() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.urgent) + len(q.background)
+}
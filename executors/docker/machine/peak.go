@@ -0,0 +1,58 @@
+package machine
+
+import (
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+)
+
+// peakSample is one observation of how many machines were running builds
+// at a given moment
+type peakSample struct {
+	At     time.Time
+	Builds int
+}
+
+// recordPeakDemand stores the current concurrent build count and prunes
+// the samples that fell out of the rolling window
+func (m *machineProvider) recordPeakDemand(builds int) {
+	m.peakLock.Lock()
+	defer m.peakLock.Unlock()
+
+	kept := m.peakSamples[:0]
+	for _, sample := range m.peakSamples {
+		if time.Since(sample.At) <= peakDemandWindow {
+			kept = append(kept, sample)
+		}
+	}
+	m.peakSamples = append(kept, peakSample{At: time.Now(), Builds: builds})
+}
+
+// rollingPeak returns the highest concurrent build count observed inside
+// the rolling window
+func (m *machineProvider) rollingPeak() (peak int) {
+	m.peakLock.Lock()
+	defer m.peakLock.Unlock()
+
+	for _, sample := range m.peakSamples {
+		if time.Since(sample.At) <= peakDemandWindow && sample.Builds > peak {
+			peak = sample.Builds
+		}
+	}
+	return
+}
+
+// peakIdleTarget sizes the idle pool as the configured percentage of the
+// rolling demand peak, so that the warm pool follows the actual traffic
+// instead of a hand-tuned constant. MinIdleCount is the floor of the
+// result and IdleCountMax, when set, its ceiling
+func (m *machineProvider) peakIdleTarget(config *common.RunnerConfig) int {
+	target := m.rollingPeak() * config.Machine.IdlePercentOfPeak / 100
+	if target < config.Machine.MinIdleCount {
+		target = config.Machine.MinIdleCount
+	}
+	if config.Machine.IdleCountMax > 0 && target > config.Machine.IdleCountMax {
+		target = config.Machine.IdleCountMax
+	}
+	return target
+}
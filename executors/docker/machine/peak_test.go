@@ -0,0 +1,31 @@
+package machine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachineIdlePercentOfPeak(t *testing.T) {
+	p, _ := testMachineProvider()
+	config := createMachineConfig(0, 5)
+	config.Machine.IdlePercentOfPeak = 50
+	config.Machine.MinIdleCount = 1
+	config.Machine.IdleCountMax = 3
+
+	// A demand peak of eight concurrent builds asks for four idle
+	// machines, clamped to the configured ceiling
+	p.recordPeakDemand(8)
+	assert.Equal(t, 3, p.idleCount(config), "the target should clamp to IdleCountMax")
+
+	// The peak ages out of the rolling window; a smaller one takes over
+	p.peakSamples[0].At = time.Now().Add(-2 * peakDemandWindow)
+	p.recordPeakDemand(4)
+	assert.Equal(t, 2, p.idleCount(config), "the target should track the configured percentage of the peak")
+
+	// A full lull falls back to the MinIdleCount floor
+	p.peakSamples = nil
+	p.recordPeakDemand(0)
+	assert.Equal(t, 1, p.idleCount(config), "a lull should keep the MinIdleCount floor")
+}
@@ -1,9 +1,15 @@
 package machine
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,142 +19,1239 @@ import (
 	"gitlab.com/gitlab-org/gitlab-runner/helpers/docker"
 )
 
+// storagePathSetter is implemented by Machine backends that can isolate
+// their machine store in a custom storage path
+type storagePathSetter interface {
+	SetStoragePath(path string)
+}
+
+// driverReporter is implemented by Machine backends that can report the
+// driver a machine was created with
+type driverReporter interface {
+	DriverName(name string) (string, error)
+}
+
+// CredentialProvider fetches short-lived driver credentials from an
+// external secret store. It is consulted before each machine creation,
+// so rotated credentials take effect without a config reload; the
+// returned options are appended to the configured MachineOptions
+type CredentialProvider interface {
+	GetCredentialOptions() ([]string, error)
+}
+
 type machineProvider struct {
 	name        string
 	machine     docker_helpers.Machine
-	details     machinesDetails
-	lock        sync.RWMutex
+	details     *detailsStore
+	detailsInit sync.Once
 	acquireLock sync.Mutex
 	// provider stores a real executor that is used to start run the builds
 	provider common.ExecutorProvider
 
+	// DryRun makes scaling decisions log and count the intended actions
+	// instead of invoking the Machine backend, so that new scaling
+	// parameters can be validated safely
+	DryRun bool
+
+	dryRunLock    sync.Mutex
+	dryRunActions map[string]int
+
+	// CredentialProvider, when set, supplies driver credential options
+	// fetched from an external secret store before each machine creation
+	CredentialProvider CredentialProvider
+
+	// IdleTargetFunc, when set, overrides the static IdleCount and drives
+	// the idle target from an external signal. It is called on each
+	// scaling sweep and must not block
+	IdleTargetFunc func(config *common.RunnerConfig) int
+
+	// ShouldRemove, when set, is consulted for every idle machine during
+	// the scaling sweep and lets operators encode bespoke removal
+	// policies; a true result removes the machine with the given reason
+	ShouldRemove func(details *machineDetails) (bool, string)
+
+	// PreAcquire, when set, is run on a machine right before it is
+	// handed out, e.g. to verify a mount or a version label. An error
+	// puts the machine back into the pool and the next candidate is
+	// tried instead
+	PreAcquire func(details *machineDetails) error
+
 	stuckRemoveLock sync.Mutex
 
+	// connectProbes bounds the number of simultaneous CanConnect probes
+	connectProbes chan struct{}
+
+	removalAudit *removalAudit
+
+	// deadLetters holds the machines whose removal was retried to
+	// exhaustion, for manual cleanup
+	deadLetters *deadLetterList
+
+	// decisionTrace keeps the recent scaling sweep decisions for the
+	// debug API; it stays nil when the trace is not enabled
+	decisionTrace *decisionTrace
+
+	// utilizationEWMA smooths the pool utilization over the scaling
+	// sweeps; sustained low demand lets the effective idle time grow
+	utilizationLock sync.Mutex
+	utilizationEWMA float64
+	lowDemandSweeps int
+
+	// creationLatencyEWMA smooths the duration of recent successful
+	// creates; a slow cloud earns the pool a few extra idle machines
+	creationLatencyLock sync.Mutex
+	creationLatencyEWMA time.Duration
+
+	// peakSamples holds the recent concurrent-build observations; their
+	// rolling maximum drives the percent-of-peak idle target
+	peakLock    sync.Mutex
+	peakSamples []peakSample
+
+	// createQueue and removeQueue bound machine creations and removals
+	// independently, as both have different cost profiles on the cloud
+	createQueue *operationQueue
+	removeQueue *operationQueue
+
+	// work caps the background goroutines of all operations combined,
+	// as a safety valve against pathological churn
+	work *workPool
+
+	// capacity signals subscribed schedulers when the pool goes from
+	// saturated back to having an acquirable machine
+	capacity capacityNotifier
+
+	// recentBuilds holds the durations of the last finished builds;
+	// their average backs the wait estimate of CapacityError
+	buildDurationsLock sync.Mutex
+	recentBuilds       []time.Duration
+
+	// imageGeneration is the base image generation new machines carry;
+	// idle machines with an older one are recycled by the sweep
+	imageGenLock    sync.Mutex
+	imageGeneration string
+
+	// waitQueue orders the AcquireContext waiters by arrival, backing
+	// the queue positions reported through WithQueueProgress
+	waitQueue waiterTickets
+
+	// acquireWaiters counts the Acquire calls that are currently waiting
+	// for the scaling sweep; a growing number indicates under-provisioning
+	waitersLock    sync.Mutex
+	acquireWaiters int
+
+	// teardownOrder controls which machines a shutdown drain removes
+	// first; it shares the drain lock below
+	teardownOrder string
+
+	// draining marks the provider as shutting down: no new machines are
+	// created and free machines are cordoned for removal
+	drainLock sync.Mutex
+	draining  bool
+
+	// doneCh is closed exactly once by Close to terminate the provider's
+	// background loops and fail subsequent Acquires
+	closeOnce sync.Once
+	doneInit  sync.Once
+	doneCh    chan struct{}
+
+	// buildsPerMachine is how many simultaneous builds one machine may
+	// run, taken from MaxConcurrentBuilds on each Acquire
+	buildsLock       sync.Mutex
+	buildsPerMachine int
+
+	// breaker stops machine creation for a cooldown after a streak of
+	// consecutive create failures
+	breaker creationBreaker
+
+	// creationHealth tracks the recent create success rate for the
+	// observability-only health signal
+	creationHealth creationHealth
+
+	// quarantineTime, when positive, parks machines that fail their
+	// health check instead of removing them, so that an engineer can
+	// inspect them before the TTL expires
+	quarantineLock sync.Mutex
+	quarantineTime time.Duration
+
+	// verifyOnce runs the startup check of the machine backend exactly
+	// once; verifyErr keeps its outcome for every later Acquire
+	verifyOnce sync.Once
+	verifyErr  error
+
+	// userDataPath caches the file that inline UserData content was
+	// written to, so that every machine creation can reuse it
+	userDataLock    sync.Mutex
+	userDataContent string
+	userDataPath    string
+
+	// jobBindings maps a job ID to the machine acquired for it, so that
+	// a retried acquire of the same job gets the machine already bound
+	// to it instead of grabbing a second one
+	jobBindingsLock sync.Mutex
+	jobBindings     map[int64]string
+
+	// idleClampOnce limits the IdleCount-above-Limit warning to a single
+	// log line; the clamp itself applies on every sweep
+	idleClampOnce sync.Once
+
+	// minIdleTarget remembers the MinIdleCount the last Acquire ran with,
+	// so that the readiness probe knows what warm pool to wait for
+	minIdleLock   sync.Mutex
+	minIdleTarget int
+
+	// events streams the machine lifecycle transitions to an external
+	// consumer; it stays nil until the first Events call
+	eventsLock sync.Mutex
+	events     chan MachineEvent
+
+	// The backend machine list is cached for a short TTL, so that rapid
+	// consumers (scaling sweeps, reconciliation, adoption) share one
+	// expensive docker-machine ls call instead of each paying for their own
+	listLock    sync.Mutex
+	listCached  []string
+	listFetched time.Time
+
 	// metrics
-	totalActions      *prometheus.CounterVec
-	currentStatesDesc *prometheus.Desc
-	creationHistogram prometheus.Histogram
+	metricsLabelsOnce       sync.Once
+	creationSuccessRateDesc *prometheus.Desc
+	totalActions            *prometheus.CounterVec
+	currentStatesDesc       *prometheus.Desc
+	acquireWaitersDesc      *prometheus.Desc
+	workQueueDepthDesc      *prometheus.Desc
+	creationHistogram       prometheus.Histogram
+	stateDurations          *prometheus.SummaryVec
+}
+
+// done returns the channel that Close closes, initializing it lazily so
+// that a zero-value provider stays usable
+func (m *machineProvider) done() chan struct{} {
+	m.doneInit.Do(func() {
+		m.doneCh = make(chan struct{})
+	})
+	return m.doneCh
+}
+
+// Close terminates the provider's background loops and makes subsequent
+// Acquire calls fail, so that tests and process shutdown don't leak
+// goroutines. It is idempotent
+func (m *machineProvider) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done())
+	})
+	return nil
+}
+
+func (m *machineProvider) isClosed() bool {
+	select {
+	case <-m.done():
+		return true
+	default:
+		return false
+	}
+}
+
+// machines returns the sharded details store, initializing it lazily so
+// that a zero-value provider stays usable
+func (m *machineProvider) machines() *detailsStore {
+	m.detailsInit.Do(func() {
+		if m.details == nil {
+			m.details = newDetailsStore(machineDetailsShards)
+		}
+	})
+	return m.details
+}
+
+// setState moves the machine into the given state and records how long
+// it spent in the previous one, so that slow or churning states show up
+// in the duration metrics
+func (m *machineProvider) setState(details *machineDetails, state machineState) {
+	if m.stateDurations != nil && !details.StateChanged.IsZero() {
+		m.stateDurations.WithLabelValues(details.State.String()).
+			Observe(time.Since(details.StateChanged).Seconds())
+	}
+	details.State = state
+	details.StateChanged = time.Now()
 }
 
 func (m *machineProvider) machineDetails(name string, acquire bool) *machineDetails {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+	shard := m.machines().shard(name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
 
-	details, ok := m.details[name]
+	details, ok := shard.details[name]
 	if !ok {
 		details = &machineDetails{
-			Name:      name,
-			Created:   time.Now(),
-			Used:      time.Now(),
-			LastSeen:  time.Now(),
-			UsedCount: 1, // any machine that we find we mark as already used
-			State:     machineStateIdle,
+			Name:         name,
+			Created:      time.Now(),
+			Used:         time.Now(),
+			LastSeen:     time.Now(),
+			UsedCount:    1, // any machine that we find we mark as already used
+			State:        machineStateIdle,
+			StateChanged: time.Now(),
+			clients:      &dockerClientCache{},
 		}
-		m.details[name] = details
+		shard.details[name] = details
 	}
 
 	if acquire {
-		if details.isUsed() {
+		switch {
+		case details.State == machineStateIdle:
+			m.setState(details, machineStateAcquired)
+		case details.State == machineStateUsed && details.ActiveBuilds < m.getBuildsPerMachine():
+			// The machine still has build capacity; it stays Used and
+			// the next build is packed onto it
+		default:
 			return nil
 		}
-		details.State = machineStateAcquired
 	}
 
 	return details
 }
 
+func (m *machineProvider) setBuildsPerMachine(count int) {
+	m.buildsLock.Lock()
+	defer m.buildsLock.Unlock()
+	m.buildsPerMachine = count
+}
+
+// getBuildsPerMachine returns how many simultaneous builds one machine
+// may run; the classic model of one build per machine is the default
+func (m *machineProvider) getBuildsPerMachine() int {
+	m.buildsLock.Lock()
+	defer m.buildsLock.Unlock()
+
+	if m.buildsPerMachine < 1 {
+		return 1
+	}
+	return m.buildsPerMachine
+}
+
 func (m *machineProvider) create(config *common.RunnerConfig, state machineState) (details *machineDetails, errCh chan error) {
+	errCh = make(chan error, 1)
+
+	if !m.breaker.allow() {
+		errCh <- errors.New("machine creation is suspended after repeated failures")
+		return nil, errCh
+	}
+
+	if err := m.checkGlobalLimit(config); err != nil {
+		errCh <- err
+		return nil, errCh
+	}
+
+	if err := m.checkFlavorLimit(config); err != nil {
+		errCh <- err
+		return nil, errCh
+	}
+
+	if err := m.checkWeightLimit(config); err != nil {
+		errCh <- err
+		return nil, errCh
+	}
+
 	name := newMachineName(config)
 	details = m.machineDetails(name, true)
-	details.State = machineStateCreating
+	m.setState(details, machineStateCreating)
 	details.UsedCount = 0
 	details.RetryCount = 0
 	details.LastSeen = time.Now()
-	errCh = make(chan error, 1)
+	details.Burst = false
+	details.Shape = config.Machine.MachineShape
+	details.Phase = machinePhaseCreate
+	details.Attempts = 0
+	details.Driver = config.Machine.MachineDriver
+	details.RunnerVersion = common.VERSION
+	details.ImageGeneration = m.getImageGeneration()
+
+	if m.DryRun {
+		m.countDryRunAction("create")
+		details.logger().Infoln("Dry-run: would create machine")
+		m.setState(details, state)
+		errCh <- nil
+		return
+	}
 
 	// Create machine asynchronously
-	go func() {
+	m.submitWork(func() {
+		if m.createQueue != nil {
+			// On-demand creations jump ahead of the background idle fill
+			m.createQueue.acquire(state == machineStateAcquired)
+			defer m.createQueue.release()
+		}
+
+		options, err := m.machineOptions(config)
+		if err != nil {
+			logrus.WithField("name", details.Name).
+				WithError(err).
+				Errorln("Failed to fetch driver credentials")
+			m.remove(details.Name, "Failed to fetch driver credentials: ", err)
+			errCh <- err
+			return
+		}
+
 		started := time.Now()
-		err := m.machine.Create(config.Machine.MachineDriver, details.Name, config.Machine.MachineOptions...)
+		details.ProvisionStarted = started
+		details.Attempts++
+		err = m.machine.Create(config.Machine.MachineDriver, details.Name, options...)
+		if isNameCollisionError(err) {
+			// The generated name already exists in the docker-machine
+			// storage: re-roll the random part of the name and retry
+			// once instead of abandoning the machine
+			newName := newMachineName(config)
+			details.logger().
+				WithError(err).
+				Warningln("Machine name already exists, retrying with a fresh name:", newName)
+			m.machines().rename(details, newName)
+			details.Attempts++
+			err = m.machine.Create(config.Machine.MachineDriver, details.Name, options...)
+		}
 		for i := 0; i < 3 && err != nil; i++ {
 			details.RetryCount++
+			details.Attempts++
+			time.Sleep(provisionRetryInterval)
+
+			if config.Machine.ProvisionRetryMode == "replace" {
+				// The driver can't re-provision a broken host: throw the
+				// half-created machine away and start over under a fresh name
+				details.Phase = machinePhaseCreate
+				logrus.WithField("name", details.Name).
+					WithError(err).
+					Warningln("Machine creation failed, replacing the machine")
+				m.machine.Remove(details.Name)
+				m.machines().rename(details, newMachineName(config))
+				err = m.machine.Create(config.Machine.MachineDriver, details.Name, options...)
+				continue
+			}
+
+			details.Phase = machinePhaseProvision
 			logrus.WithField("name", details.Name).
 				WithError(err).
 				Warningln("Machine creation failed, trying to provision")
-			time.Sleep(provisionRetryInterval)
 			err = m.machine.Provision(details.Name)
 		}
 
+		if err == nil {
+			// Probe the fresh machine before it transitions into the pool.
+			// Idle and standby machines must be usable the moment they are
+			// handed out, so a failed probe or credential verification
+			// sends them to removal; on-demand machines only get a warning
+			// here, as Use verifies them again anyway
+			details.Phase = machinePhaseConnectCheck
+			switch {
+			case !m.canConnect(details.Name, true):
+				if state == machineStateAcquired {
+					details.logger().
+						Warningln("Machine was created, but can't be reached yet")
+				} else {
+					err = errors.New("machine is unreachable after creation")
+				}
+			case state != machineStateAcquired:
+				err = m.guardDriverCall(details.Name, func() (err error) {
+					dc, err := m.machine.Credentials(details.Name)
+					if err != nil {
+						return err
+					}
+					if err = validateCredentials(dc); err != nil {
+						return err
+					}
+					details.Node = dc.Host
+					return nil
+				})
+			}
+		}
+
 		if err != nil {
 			logrus.WithField("name", details.Name).
 				WithField("time", time.Since(started)).
 				WithError(err).
 				Errorln("Machine creation failed")
-			m.remove(details.Name, "Failed to create")
+			m.breaker.failure()
+			m.creationHealth.record(false)
+			m.remove(details.Name, "Failed to create: ", err)
 		} else {
-			details.State = state
+			m.breaker.success()
+			m.creationHealth.record(true)
+			m.invalidateListCache()
+			details.Phase = machinePhaseReady
+			m.setState(details, state)
 			details.Used = time.Now()
 			creationTime := time.Since(started)
 			logrus.WithField("time", creationTime).
 				WithField("name", details.Name).
 				WithField("now", time.Now()).
 				WithField("retries", details.RetryCount).
+				WithField("attempts", details.Attempts).
 				Infoln("Machine created")
 			m.totalActions.WithLabelValues("created").Inc()
 			m.creationHistogram.Observe(creationTime.Seconds())
+			m.recordCreationLatency(creationTime)
+			m.emitEvent(MachineEventCreated, details.Name, "")
+			if state == machineStateIdle {
+				m.capacity.notifyAvailable()
+			}
 		}
 		errCh <- err
-	}()
+	})
 	return
 }
 
-func (m *machineProvider) findFreeMachine(skipCache bool, machines ...string) (details *machineDetails) {
-	// Enumerate all machines in reverse order, to always take the newest machines first
+// machineOptions returns the creation options for a new machine: the
+// configured ones with their template tokens rendered, extended with
+// freshly fetched driver credentials when a CredentialProvider is
+// plugged in
+func (m *machineProvider) machineOptions(config *common.RunnerConfig) ([]string, error) {
+	options, err := renderMachineOptions(config, config.Machine.MachineOptions)
+	if err != nil {
+		return nil, err
+	}
+	userData, err := m.userDataOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, userData...)
+	if m.CredentialProvider == nil {
+		return options, nil
+	}
+
+	credentials, err := m.CredentialProvider.GetCredentialOptions()
+	if err != nil {
+		return nil, err
+	}
+	return append(options, credentials...), nil
+}
+
+// renderMachineOptions resolves template tokens like {{.Region}} in the
+// configured machine options against the runner's environment variables,
+// so that driver options can carry values only known at runtime. An
+// unresolvable token fails the creation instead of producing a machine
+// with a mangled option
+func renderMachineOptions(config *common.RunnerConfig, options []string) ([]string, error) {
+	data := make(map[string]string, len(config.Environment))
+	for _, keyValue := range config.Environment {
+		if parts := strings.SplitN(keyValue, "=", 2); len(parts) == 2 {
+			data[parts[0]] = parts[1]
+		}
+	}
+
+	rendered := make([]string, 0, len(options))
+	for _, option := range options {
+		if !strings.Contains(option, "{{") {
+			rendered = append(rendered, option)
+			continue
+		}
+
+		tmpl, err := template.New("machine-option").Option("missingkey=error").Parse(option)
+		if err != nil {
+			return nil, fmt.Errorf("invalid machine option template %q: %v", option, err)
+		}
+		var buffer bytes.Buffer
+		if err = tmpl.Execute(&buffer, data); err != nil {
+			return nil, fmt.Errorf("can't render machine option %q: %v", option, err)
+		}
+		rendered = append(rendered, buffer.String())
+	}
+	return rendered, nil
+}
+
+// isNameCollisionError tells whether machine creation failed because the
+// generated name is already taken in the docker-machine storage
+func isNameCollisionError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "already exists")
+}
+
+func (m *machineProvider) countDryRunAction(action string) {
+	m.dryRunLock.Lock()
+	defer m.dryRunLock.Unlock()
+
+	if m.dryRunActions == nil {
+		m.dryRunActions = make(map[string]int)
+	}
+	m.dryRunActions[action]++
+}
+
+// DryRunActions returns how many times each action would have been
+// executed while running in dry-run mode
+func (m *machineProvider) DryRunActions() map[string]int {
+	m.dryRunLock.Lock()
+	defer m.dryRunLock.Unlock()
+
+	actions := make(map[string]int, len(m.dryRunActions))
+	for action, count := range m.dryRunActions {
+		actions[action] = count
+	}
+	return actions
+}
+
+func (m *machineProvider) addAcquireWaiter(delta int) {
+	m.waitersLock.Lock()
+	defer m.waitersLock.Unlock()
+	m.acquireWaiters += delta
+}
+
+// AcquireWaiters returns the number of Acquire calls currently waiting
+// for a machine
+func (m *machineProvider) AcquireWaiters() int {
+	m.waitersLock.Lock()
+	defer m.waitersLock.Unlock()
+	return m.acquireWaiters
+}
+
+func (m *machineProvider) trackUtilization(data *machinesData) {
+	var utilization float64
+	if total := data.Total(); total > 0 {
+		utilization = float64(data.Used) / float64(total)
+	}
+
+	m.utilizationLock.Lock()
+	defer m.utilizationLock.Unlock()
+
+	m.utilizationEWMA = utilizationEWMAAlpha*utilization + (1-utilizationEWMAAlpha)*m.utilizationEWMA
+	if m.utilizationEWMA < lowUtilizationThreshold {
+		m.lowDemandSweeps++
+	} else {
+		m.lowDemandSweeps = 0
+	}
+}
+
+// machineUtilization describes how much of its lifetime a single machine
+// has spent running builds
+type machineUtilization struct {
+	Name         string
+	Lifetime     time.Duration
+	UsedTime     time.Duration
+	UsedFraction float64
+}
+
+// Utilization reports the used fraction of every tracked machine along
+// with the pool-wide fraction, weighted by machine lifetime. It feeds
+// right-sizing decisions for IdleCount
+func (m *machineProvider) Utilization() (machines []machineUtilization, poolUsedFraction float64) {
+	var totalLifetime, totalUsed time.Duration
+
+	m.machines().each(func(details *machineDetails) {
+		usage := machineUtilization{
+			Name:     details.Name,
+			Lifetime: time.Since(details.Created),
+			UsedTime: details.usedDuration(),
+		}
+		if usage.Lifetime > 0 {
+			usage.UsedFraction = float64(usage.UsedTime) / float64(usage.Lifetime)
+		}
+
+		totalLifetime += usage.Lifetime
+		totalUsed += usage.UsedTime
+		machines = append(machines, usage)
+	})
+
+	if totalLifetime > 0 {
+		poolUsedFraction = float64(totalUsed) / float64(totalLifetime)
+	}
+	return
+}
+
+// machineAgeBucket counts the machines whose age is below UpTo; the
+// final bucket has UpTo zero and collects everything older
+type machineAgeBucket struct {
+	UpTo  time.Duration
+	Count int
+}
+
+// AgeDistribution buckets the tracked machines by their age. A healthy
+// rotation spreads machines across buckets; a cluster in a single one
+// means the lifetime rotation will replace them all at once and the
+// creation jitter needs tuning
+func (m *machineProvider) AgeDistribution() []machineAgeBucket {
+	buckets := make([]machineAgeBucket, len(machineAgeBuckets)+1)
+	for i, upTo := range machineAgeBuckets {
+		buckets[i].UpTo = upTo
+	}
+
+	m.machines().each(func(details *machineDetails) {
+		age := time.Since(details.Created)
+		for i, upTo := range machineAgeBuckets {
+			if age < upTo {
+				buckets[i].Count++
+				return
+			}
+		}
+		buckets[len(buckets)-1].Count++
+	})
+	return buckets
+}
+
+// idleTime returns the effective idle time: under sustained low demand
+// it grows above the configured base, up to a cap, to avoid churning
+// machines during brief lulls
+func (m *machineProvider) idleTime(config *common.RunnerConfig) time.Duration {
+	base := time.Second * time.Duration(config.Machine.GetIdleTime())
+
+	m.utilizationLock.Lock()
+	defer m.utilizationLock.Unlock()
+
+	growth := 1 + m.lowDemandSweeps
+	if growth > maxIdleTimeGrowth {
+		growth = maxIdleTimeGrowth
+	}
+	return base * time.Duration(growth)
+}
+
+func (m *machineProvider) idleCount(config *common.RunnerConfig) int {
+	// An explicit on-demand mode never keeps a warm pool, even when a
+	// stale IdleCount is still configured
+	if config.Machine.Mode == "on-demand" {
+		return 0
+	}
+
+	var target int
+	switch {
+	case m.IdleTargetFunc != nil:
+		target = m.IdleTargetFunc(config)
+	case config.Machine.IdlePercentOfPeak > 0:
+		target = m.peakIdleTarget(config)
+	default:
+		target = config.Machine.GetIdleCount()
+	}
+
+	// Slow creates are hidden behind a deeper warm pool: jobs keep
+	// finding idle machines while the replacements are still
+	// provisioning. A pool that aims for zero idle stays at zero
+	if target > 0 {
+		target += m.latencyIdleBoost()
+	}
+
+	// A config reload can leave the idle target above Limit; cap it at
+	// the limit plus the burst allowance, so the sweep doesn't create
+	// machines it can never keep
+	ceiling := config.Limit + config.LimitBurst
+	if config.Limit > 0 && target > ceiling {
+		m.idleClampOnce.Do(func() {
+			logrus.WithField("name", m.name).
+				Warningln("IdleCount exceeds Limit; capping the idle target at", ceiling)
+		})
+		target = ceiling
+	}
+	return target
+}
+
+// EffectiveScalingConfig is the scaling configuration the provider is
+// acting on right now, after off-peak windows, dynamic idle targets and
+// the configured floors have been resolved
+type EffectiveScalingConfig struct {
+	IdleCount    int
+	MinIdleCount int
+	IdleTime     time.Duration
+	Limit        int
+}
+
+// RemoveByReason schedules removal for every machine whose recorded
+// Reason matches, e.g. to flush a batch that one bad image sent into
+// quarantine. Machines that run or are about to run a build are left to
+// finish; the returned count is how many removals were scheduled
+func (m *machineProvider) RemoveByReason(reason string) int {
+	var matching []string
+	m.machines().each(func(details *machineDetails) {
+		if details.Reason != reason || details.canBeUsed() || details.State == machineStateRemoving {
+			return
+		}
+		matching = append(matching, details.Name)
+	})
+
+	removed := 0
+	for _, name := range matching {
+		if err := m.remove(name, reason); err == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+// DrainByVersion schedules removal for every machine created by the
+// given runner version, so that the old fleet can be retired after a
+// rolling upgrade. Machines that run or are about to run a build finish
+// first and are picked up by a later drain; the returned count is how
+// many removals were scheduled
+func (m *machineProvider) DrainByVersion(version string) int {
+	var matching []string
+	m.machines().each(func(details *machineDetails) {
+		if details.RunnerVersion != version || details.canBeUsed() || details.State == machineStateRemoving {
+			return
+		}
+		matching = append(matching, details.Name)
+	})
+
+	removed := 0
+	for _, name := range matching {
+		if err := m.remove(name, "Draining runner version ", version); err == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+// Reserve pins the named machine in the pool: no scaling sweep or
+// lifetime rotation removes it, while builds keep acquiring it as usual.
+// Reserving an untracked machine does nothing
+func (m *machineProvider) Reserve(name string) {
+	if details := m.machines().get(name); details != nil {
+		details.Reserved = true
+	}
+}
+
+// Unreserve lifts the pin set by Reserve, putting the machine back
+// under the regular scaling rules
+func (m *machineProvider) Unreserve(name string) {
+	if details := m.machines().get(name); details != nil {
+		details.Reserved = false
+	}
+}
+
+// EffectiveConfig resolves the scaling settings for the given config at
+// this moment. It is read-only and meant for answering "why isn't the
+// pool scaling like I configured" without reverse-engineering overrides
+func (m *machineProvider) EffectiveConfig(config *common.RunnerConfig) EffectiveScalingConfig {
+	return EffectiveScalingConfig{
+		IdleCount:    m.idleCount(config),
+		MinIdleCount: config.Machine.MinIdleCount,
+		IdleTime:     m.idleTime(config),
+		Limit:        config.Limit,
+	}
+}
+
+// handleCredentialFailure counts consecutive credential errors for a
+// machine that otherwise connects fine. Once the configured threshold is
+// reached the machine is removed rather than released, since a host that
+// persistently fails to yield credentials is usually broken. It reports
+// whether the machine was sent to removal
+func (m *machineProvider) handleCredentialFailure(config *common.RunnerConfig, details *machineDetails) bool {
+	details.CredentialFailures++
+	threshold := config.Machine.MaxCredentialFailures
+	if threshold <= 0 || details.CredentialFailures < threshold {
+		return false
+	}
+	m.remove(details.Name, "Too many credential failures")
+	return true
+}
+
+// validateCredentials rejects credentials a driver handed back without
+// an error but that can't actually reach a docker daemon: an empty host,
+// or TLS verification requested without a certificate path. Treating
+// them as a failure here keeps broken machines out of builds
+func validateCredentials(dc docker_helpers.DockerCredentials) error {
+	if dc.Host == "" {
+		return errors.New("machine returned credentials without a host")
+	}
+	if dc.TLSVerify && dc.CertPath == "" {
+		return errors.New("machine returned TLS credentials without a certificate path")
+	}
+	return nil
+}
+
+// recordMachineError keeps the most recent driver error on the machine
+// details, so that a flapping host can be diagnosed from the debug API.
+// A later success deliberately leaves the record in place
+func (m *machineProvider) recordMachineError(name string, err error) {
+	if err == nil {
+		return
+	}
+	if details := m.machines().get(name); details != nil {
+		details.LastError = err.Error()
+		details.LastErrorAt = time.Now()
+	}
+}
+
+// guardDriverCall shields the acquire/use path from a panicking Machine
+// implementation: a panic is logged with its stack and converted into an
+// error, instead of taking down the whole provider. Whatever error comes
+// out is recorded on the machine details
+func (m *machineProvider) guardDriverCall(name string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.WithField("name", name).
+				Errorln("Recovered from machine driver panic:", r, "\n", string(debug.Stack()))
+			err = fmt.Errorf("machine driver panicked: %v", r)
+		}
+		m.recordMachineError(name, err)
+	}()
+	return fn()
+}
+
+// canConnect probes the machine connectivity, bounding the number of
+// simultaneous probes so that scanning a large pool doesn't open an SSH
+// storm against the fleet
+func (m *machineProvider) canConnect(name string, skipCache bool) bool {
+	if m.DryRun {
+		return true
+	}
+
+	if m.connectProbes != nil {
+		m.connectProbes <- struct{}{}
+		defer func() {
+			<-m.connectProbes
+		}()
+	}
+
+	var canConnect bool
+	err := m.guardDriverCall(name, func() error {
+		canConnect = m.machine.CanConnect(name, skipCache)
+		return nil
+	})
+	return err == nil && canConnect
+}
+
+// canConnectWithBackoff retries a failed connectivity probe with an
+// exponential backoff, to smooth over machines under transient load
+func (m *machineProvider) canConnectWithBackoff(config *common.RunnerConfig, name string, skipCache bool) bool {
+	if config == nil || config.Machine == nil {
+		return m.canConnect(name, skipCache)
+	}
+
+	interval := time.Duration(config.Machine.ConnectRetryInterval) * time.Second
+	if interval <= 0 {
+		interval = connectRetryInterval
+	}
+
+	for i := 0; ; i++ {
+		if m.canConnect(name, skipCache) {
+			return true
+		}
+		if i >= config.Machine.ConnectRetries {
+			return false
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+func (m *machineProvider) findFreeMachine(shape, affinity string, skipCache bool, machines ...string) *machineDetails {
+	// Sort the candidates by name, so that the selection doesn't depend
+	// on the backend listing order. Machine names embed their creation
+	// time, which keeps the reverse iteration below preferring the
+	// newest machines
+	machines = append([]string(nil), machines...)
+	sort.Strings(machines)
+
+	// Prefer the machine that last ran the same project, to land on its
+	// warm caches. The preference is soft: when every affine machine is
+	// busy we fall through to any free machine instead of waiting
+	if affinity != "" {
+		if details := m.findFreeMachineIn(shape, affinity, skipCache, false, machines); details != nil {
+			return details
+		}
+	}
+
+	// Favor the machines this process created over adopted ones with
+	// unknown history, so the legacy fleet drains naturally. Again a
+	// soft preference: when only adopted machines are free we take them
+	if details := m.findFreeMachineIn(shape, "", skipCache, true, machines); details != nil {
+		return details
+	}
+
+	return m.findFreeMachineIn(shape, "", skipCache, false, machines)
+}
+
+func (m *machineProvider) findFreeMachineIn(shape, affinity string, skipCache bool, skipAdopted bool, machines []string) (details *machineDetails) {
+	// Enumerate all machines in reverse order, to always take the newest
+	// machines first and stop probing as soon as one of them is acquirable
 	for idx := range machines {
 		name := machines[len(machines)-idx-1]
+
+		// Only hand out machines of a compatible shape; a shape never
+		// changes after creation
+		candidate := m.machineDetails(name, false)
+		if candidate.Shape != shape {
+			continue
+		}
+		if skipAdopted && candidate.Adopted {
+			continue
+		}
+		if affinity != "" && candidate.LastProject != affinity {
+			continue
+		}
+
+		// A machine still cooling down after its last build is idle but
+		// not selectable yet
+		if time.Now().Before(candidate.CooldownUntil) {
+			continue
+		}
+
 		details := m.machineDetails(name, true)
 		if details == nil {
 			continue
 		}
 
 		// Check if node is running
-		canConnect := m.machine.CanConnect(name, skipCache)
+		canConnect := m.canConnect(name, skipCache)
 		if !canConnect {
-			m.remove(name, "machine is unavailable")
+			m.failMachine(name, "machine is unavailable")
 			continue
 		}
+
+		// The operator gate gets the final say: a rejected machine is
+		// returned to the pool, not removed
+		if m.PreAcquire != nil {
+			if err := m.PreAcquire(details); err != nil {
+				details.logger().
+					WithError(err).
+					Warningln("Machine rejected by the PreAcquire hook")
+				if details.State == machineStateAcquired {
+					m.setState(details, machineStateIdle)
+				}
+				continue
+			}
+		}
+
+		m.emitEvent(MachineEventAcquired, details.Name, "")
 		return details
 	}
 
 	return nil
 }
 
-func (m *machineProvider) useMachine(config *common.RunnerConfig) (details *machineDetails, err error) {
+// estimateFleetCost sums the estimated accrued cost of all machines that
+// are not being removed. It's a soft guardrail, not billing-accurate
+func (m *machineProvider) estimateFleetCost(hourlyCost float64) float64 {
+	var cost float64
+	m.machines().each(func(details *machineDetails) {
+		if details.State == machineStateRemoving {
+			return
+		}
+		cost += hourlyCost * time.Since(details.Created).Hours()
+	})
+	return cost
+}
+
+// checkGlobalLimit enforces MaxTotalMachines across every runner config
+// sharing this provider: unlike Limit, which only sees the machines of
+// the current config, it counts all tracked machines
+func (m *machineProvider) checkGlobalLimit(config *common.RunnerConfig) error {
+	if config.Machine.MaxTotalMachines <= 0 {
+		return nil
+	}
+
+	total := 0
+	m.machines().each(func(details *machineDetails) {
+		if details.State != machineStateRemoving {
+			total++
+		}
+	})
+
+	if total >= config.Machine.MaxTotalMachines {
+		return fmt.Errorf("global machine limit of %d reached", config.Machine.MaxTotalMachines)
+	}
+	return nil
+}
+
+// machineWeight returns how much of the weight cap one machine of the
+// given shape consumes; flavors may declare their own weight, everything
+// else counts as 1
+func machineWeight(config *common.RunnerConfig, shape string) int {
+	if flavor := findFlavor(config, shape); flavor != nil && flavor.Weight > 0 {
+		return flavor.Weight
+	}
+	return 1
+}
+
+// checkWeightLimit enforces MaxWeight against the summed flavor weights
+// of all tracked machines, so that with mixed machine sizes two big
+// machines can take as much of the cap as four small ones
+func (m *machineProvider) checkWeightLimit(config *common.RunnerConfig) error {
+	if config.Machine.MaxWeight <= 0 {
+		return nil
+	}
+
+	total := machineWeight(config, machineShape(config))
+	m.machines().each(func(details *machineDetails) {
+		if details.State != machineStateRemoving {
+			total += machineWeight(config, details.Shape)
+		}
+	})
+
+	if total > config.Machine.MaxWeight {
+		return fmt.Errorf("machine weight limit of %d reached", config.Machine.MaxWeight)
+	}
+	return nil
+}
+
+func (m *machineProvider) checkBudget(config *common.RunnerConfig) error {
+	if config.Machine.MonthlyBudget <= 0 || config.Machine.HourlyCost <= 0 {
+		return nil
+	}
+
+	projected := m.estimateFleetCost(config.Machine.HourlyCost) + config.Machine.HourlyCost
+	if projected > config.Machine.MonthlyBudget {
+		return fmt.Errorf("projected cost %.2f exceeds the monthly budget %.2f", projected, config.Machine.MonthlyBudget)
+	}
+	return nil
+}
+
+// errAcquireTimedOut is returned when the combined create, connect and
+// credential chain exceeds the configured AcquireTimeout
+var errAcquireTimedOut = errors.New("timed out while acquiring a machine")
+
+// useMachine hands out a machine of the requested shape, creating one on
+// demand; when the requested flavor cannot produce a machine its
+// configured fallback chain is tried before the error is surfaced
+func (m *machineProvider) useMachine(config *common.RunnerConfig, deadline time.Time) (details *machineDetails, err error) {
+	details, err = m.useShapeMachine(config, deadline)
+	if err == nil || err == errAcquireTimedOut {
+		return
+	}
+	return m.useFallbackFlavor(config, deadline, err)
+}
+
+func (m *machineProvider) useShapeMachine(config *common.RunnerConfig, deadline time.Time) (details *machineDetails, err error) {
 	machines, err := m.loadMachines(config)
 	if err != nil {
 		return
 	}
-	details = m.findFreeMachine(true, machines...)
+	details = m.findFreeMachine(machineShape(config), affinityKey(config), true, machines...)
 	if details == nil {
+		if config.Machine.NoCreate {
+			err = errors.New("No free machines and on-demand creation is disabled")
+			return
+		}
+
+		if m.isDraining() {
+			err = errors.New("provider is draining")
+			return
+		}
+
+		err = m.checkBudget(config)
+		if err != nil {
+			return
+		}
+
 		var errCh chan error
 		details, errCh = m.create(config, machineStateAcquired)
-		err = <-errCh
+		if deadline.IsZero() {
+			err = <-errCh
+			return
+		}
+
+		select {
+		case err = <-errCh:
+		case <-time.After(time.Until(deadline)):
+			// The creation chain overran the overall deadline: abandon
+			// the half-created machine instead of blocking the job longer
+			if details != nil {
+				m.remove(details.Name, "Acquire timed out")
+			}
+			details = nil
+			err = errAcquireTimedOut
+		}
 	}
 	return
 }
 
 func (m *machineProvider) retryUseMachine(config *common.RunnerConfig) (details *machineDetails, err error) {
+	var deadline time.Time
+	if config.Machine.AcquireTimeout > 0 {
+		deadline = time.Now().Add(time.Second * time.Duration(config.Machine.AcquireTimeout))
+	}
+
 	// Try to find a machine
 	for i := 0; i < 3; i++ {
-		details, err = m.useMachine(config)
+		details, err = m.useMachine(config, deadline)
 		if err == nil {
 			break
 		}
+		if err == errAcquireTimedOut {
+			// The overall deadline is spent; retrying would only blow
+			// further past it
+			break
+		}
+		if config.Machine.NoCreate {
+			// Fail fast: retrying won't create the missing machine
+			break
+		}
 		time.Sleep(provisionRetryInterval)
 	}
 	return
 }
 
+func (m *machineProvider) setQuarantineTime(ttl time.Duration) {
+	m.quarantineLock.Lock()
+	defer m.quarantineLock.Unlock()
+	m.quarantineTime = ttl
+}
+
+func (m *machineProvider) getQuarantineTime() time.Duration {
+	m.quarantineLock.Lock()
+	defer m.quarantineLock.Unlock()
+	return m.quarantineTime
+}
+
+func (m *machineProvider) setMinIdleTarget(count int) {
+	m.minIdleLock.Lock()
+	defer m.minIdleLock.Unlock()
+	m.minIdleTarget = count
+}
+
+func (m *machineProvider) getMinIdleTarget() int {
+	m.minIdleLock.Lock()
+	defer m.minIdleLock.Unlock()
+	return m.minIdleTarget
+}
+
+// Ready reports whether the provider can serve builds: the machine
+// backend answers List and the warm pool has reached the MinIdleCount
+// the last Acquire configured. Orchestrators can wire it into a
+// readiness probe, so that no jobs are routed before the warm pool exists
+func (m *machineProvider) Ready() (bool, string) {
+	if m.isClosed() {
+		return false, "provider is closed"
+	}
+
+	if _, err := m.listMachines(); err != nil {
+		return false, fmt.Sprintf("machine backend is not answering: %v", err)
+	}
+
+	if target := m.getMinIdleTarget(); target > 0 {
+		idle := 0
+		m.machines().each(func(details *machineDetails) {
+			if details.State == machineStateIdle {
+				idle++
+			}
+		})
+		if idle < target {
+			return false, fmt.Sprintf("warm pool not ready: %d of %d idle machines", idle, target)
+		}
+	}
+	return true, ""
+}
+
+// failMachine takes a machine that failed its health check out of
+// scheduling: with quarantine enabled it is parked for inspection until
+// the TTL expires, otherwise it is removed right away
+func (m *machineProvider) failMachine(machineName string, reason ...interface{}) {
+	if m.getQuarantineTime() > 0 {
+		m.quarantine(machineName, reason...)
+		return
+	}
+	m.remove(machineName, reason...)
+}
+
+// quarantine excludes the machine from scheduling but keeps it alive, so
+// that an engineer can SSH in and debug the failure. The scaling sweep
+// removes it once its quarantine TTL expires
+func (m *machineProvider) quarantine(machineName string, reason ...interface{}) {
+	shard := m.machines().shard(machineName)
+
+	shard.lock.Lock()
+	details := shard.details[machineName]
+	if details == nil {
+		shard.lock.Unlock()
+		return
+	}
+	details.Reason = fmt.Sprint(reason...)
+	m.setState(details, machineStateQuarantine)
+	details.Used = time.Now()
+	shard.lock.Unlock()
+
+	details.logger().
+		Warningln("Quarantining machine for inspection")
+}
+
 func (m *machineProvider) removeMachine(details *machineDetails) (err error) {
 	if !m.machine.Exist(details.Name) {
 		details.logger().
@@ -176,60 +1279,312 @@ func (m *machineProvider) removeMachine(details *machineDetails) (err error) {
 	err = m.machine.Remove(details.Name)
 	if err != nil {
 		details.RetryCount++
-		time.Sleep(removeRetryInterval)
 		return err
 	}
 
 	return nil
 }
 
-func (m *machineProvider) finalizeRemoval(details *machineDetails) {
-	for {
-		err := m.removeMachine(details)
-		if err == nil {
-			break
+func (m *machineProvider) finalizeRemoval(details *machineDetails) {
+	if m.removeQueue != nil {
+		m.removeQueue.acquire(false)
+		defer m.removeQueue.release()
+	}
+
+	// Cloud APIs fail transiently all the time, so back off between the
+	// attempts instead of hammering the backend. A machine that cannot
+	// be removed even after that is dead-lettered for manual cleanup
+	var err error
+	backoff := removeRetryInterval
+	for try := 0; try < removeDeadLetterTries; try++ {
+		if try > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > removeRetryMaxInterval {
+				backoff = removeRetryMaxInterval
+			}
+		}
+
+		err = m.removeMachine(details)
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		details.logger().
+			WithError(err).
+			WithField("retries", details.RetryCount).
+			Errorln("Giving up on machine removal")
+
+		if m.deadLetters != nil {
+			m.deadLetters.Add(details, err)
+		}
+
+		m.machines().remove(details.Name)
+		m.invalidateListCache()
+		return
+	}
+
+	m.machines().remove(details.Name)
+	m.invalidateListCache()
+
+	details.logger().
+		WithField("now", time.Now()).
+		WithField("retries", details.RetryCount).
+		Infoln("Machine removed")
+
+	m.totalActions.WithLabelValues("removed").Inc()
+}
+
+func (m *machineProvider) remove(machineName string, reason ...interface{}) error {
+	shard := m.machines().shard(machineName)
+
+	shard.lock.Lock()
+	details := shard.details[machineName]
+	if details == nil {
+		shard.lock.Unlock()
+		// Removal of a machine that we don't track is a safe no-op:
+		// nothing is scheduled and the other machines are left untouched
+		return errors.New("Machine not found")
+	}
+
+	wasStandby := details.State == machineStateStandby
+
+	details.Reason = fmt.Sprint(reason...)
+	m.setState(details, machineStateRemoving)
+	details.RetryCount = 0
+
+	if m.DryRun {
+		delete(shard.details, machineName)
+	}
+	shard.lock.Unlock()
+
+	// A machine on its way out won't serve builds again: drop the Docker
+	// connection its builds were sharing
+	if details.clients != nil {
+		details.clients.invalidate()
+	}
+
+	// Promote a warm standby to replace the lost capacity instantly.
+	// This visits the other shards, so it must not run under our own
+	// shard lock
+	if !wasStandby {
+		m.promoteStandby()
+	}
+
+	details.logger().
+		WithField("now", time.Now()).
+		Warningln("Requesting machine removal")
+
+	details.Used = time.Now()
+	details.writeDebugInformation()
+
+	if m.removalAudit != nil {
+		m.removalAudit.Add(details)
+	}
+
+	m.emitEvent(MachineEventRemoved, details.Name, details.Reason)
+
+	if m.DryRun {
+		m.countDryRunAction("remove")
+		details.logger().Warningln("Dry-run: would remove machine")
+		return nil
+	}
+
+	m.submitWork(func() {
+		m.finalizeRemoval(details)
+	})
+	return nil
+}
+
+// Reconcile re-lists the machines from the backend and reconciles the
+// tracked details with it: idle entries whose machines no longer exist
+// are dropped and unknown machines are adopted as idle. Machines that
+// are mid-build or otherwise in flight are left untouched
+func (m *machineProvider) Reconcile() error {
+	machines, err := m.listMachines()
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]struct{}, len(machines))
+	for _, name := range machines {
+		listed[name] = struct{}{}
+	}
+
+	m.machines().sweep(func(details *machineDetails) bool {
+		if _, ok := listed[details.Name]; ok {
+			details.LastSeen = time.Now()
+			return false
+		}
+		if details.State == machineStateIdle {
+			details.logger().
+				Warningln("Dropping machine that no longer exists")
+			return true
+		}
+		return false
+	})
+
+	// Adopt machines that we don't track yet as idle. A machine that is
+	// briefly unreachable (e.g. still booting after a runner restart) is
+	// parked and re-probed instead of being removed right away
+	var unknown []string
+	for _, name := range machines {
+		if m.machines().get(name) == nil {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	logrus.WithField("machines", len(unknown)).
+		Infoln("Adopting existing machines")
+
+	// A fleet can hold hundreds of machines after a restart; probing them
+	// one by one would stall startup, so the probes run on a bounded
+	// worker pool
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, adoptionConcurrency)
+	for _, name := range unknown {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			details := m.machineDetails(name, false)
+			details.Adopted = true
+			if m.canConnect(name, true) {
+				m.captureMachineInfo(details)
+				return
+			}
+
+			m.setState(details, machineStateCreating)
+			details.Phase = machinePhaseConnectCheck
+			go m.retryAdoption(details)
+		}(name)
+	}
+	wg.Wait()
+
+	adopted := 0
+	for _, name := range unknown {
+		if details := m.machines().get(name); details != nil && details.State == machineStateIdle {
+			adopted++
+		}
+	}
+	logrus.WithField("adopted", adopted).
+		WithField("parked", len(unknown)-adopted).
+		Infoln("Machine adoption finished")
+	return nil
+}
+
+// captureMachineInfo fills in the driver and node of a machine the
+// provider didn't create itself, asking the backend for whatever it can
+// report. Failures are ignored: the fields are informational
+func (m *machineProvider) captureMachineInfo(details *machineDetails) {
+	if details.Driver == "" {
+		if reporter, ok := m.machine.(driverReporter); ok {
+			if driver, err := reporter.DriverName(details.Name); err == nil {
+				details.Driver = driver
+			}
+		}
+	}
+	if details.Node == "" {
+		if dc, err := m.machine.Credentials(details.Name); err == nil {
+			details.Node = dc.Host
 		}
 	}
+}
 
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	delete(m.details, details.Name)
+// retryAdoption re-probes an adopted machine that wasn't reachable yet:
+// it joins the idle pool on the first successful probe and is removed as
+// permanently unreachable once the probes are exhausted
+func (m *machineProvider) retryAdoption(details *machineDetails) {
+	for i := 0; i < adoptionRetryTries; i++ {
+		time.Sleep(adoptionRetryInterval)
+		if m.canConnect(details.Name, true) {
+			details.logger().
+				Infoln("Adopted machine became reachable")
+			m.captureMachineInfo(details)
+			m.setState(details, machineStateIdle)
+			details.Phase = machinePhaseReady
+			details.Used = time.Now()
+			return
+		}
+	}
+	m.remove(details.Name, "Machine is unreachable after adoption")
+}
 
-	details.logger().
-		WithField("now", time.Now()).
-		WithField("retries", details.RetryCount).
-		Infoln("Machine removed")
+// promoteStandby moves one warm standby machine into the idle pool
+func (m *machineProvider) promoteStandby() {
+	if m.isDraining() {
+		return
+	}
 
-	m.totalActions.WithLabelValues("removed").Inc()
+	promoted := false
+	m.machines().each(func(details *machineDetails) {
+		if promoted || details.State != machineStateStandby {
+			return
+		}
+		details.logger().
+			Infoln("Promoting standby machine")
+		m.setState(details, machineStateIdle)
+		details.Used = time.Now()
+		promoted = true
+	})
 }
 
-func (m *machineProvider) remove(machineName string, reason ...interface{}) error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// RemovalAudit returns a copy of the recent machine removal records,
+// which are kept for debugging purposes
+func (m *machineProvider) RemovalAudit() []removalAuditEntry {
+	if m.removalAudit == nil {
+		return nil
+	}
+	return m.removalAudit.Entries()
+}
 
-	details, _ := m.details[machineName]
-	if details == nil {
-		return errors.New("Machine not found")
+func (m *machineProvider) updateMachine(config *common.RunnerConfig, data *machinesData, details *machineDetails) error {
+	if details.State == machineStateQuarantine {
+		if time.Since(details.Used) > time.Second*time.Duration(config.Machine.QuarantineTime) {
+			// Keep quarantined machines around only for their TTL
+			return errors.New("Quarantine expired")
+		}
+		return nil
 	}
 
-	details.Reason = fmt.Sprint(reason...)
-	details.State = machineStateRemoving
-	details.RetryCount = 0
+	if details.stuckCreating(config.Machine.CreationTimeout) {
+		// Replace machines whose provisioning doesn't finish
+		return errors.New("Stuck creating")
+	}
 
-	details.logger().
-		WithField("now", time.Now()).
-		Warningln("Requesting machine removal")
+	if details.State != machineStateIdle {
+		return nil
+	}
 
-	details.Used = time.Now()
-	details.writeDebugInformation()
+	// Reserved machines are pinned: no sweep ever removes them
+	if details.Reserved {
+		return nil
+	}
 
-	go m.finalizeRemoval(details)
-	return nil
-}
+	// Custom removal policies get the first say in the idle sweep
+	if m.ShouldRemove != nil {
+		if shouldRemove, reason := m.ShouldRemove(details); shouldRemove {
+			return errors.New(reason)
+		}
+	}
 
-func (m *machineProvider) updateMachine(config *common.RunnerConfig, data *machinesData, details *machineDetails) error {
-	if details.State != machineStateIdle {
-		return nil
+	// A machine created before the current image generation still
+	// carries the old cached base image; recycle it rather than hand
+	// stale caches to the next build
+	if gen := m.getImageGeneration(); gen != "" && details.ImageGeneration != gen {
+		return errors.New("Stale image generation")
+	}
+
+	// Flavored machines are evaluated against their own flavor targets
+	if flavor := findFlavor(config, details.Shape); flavor != nil {
+		return m.updateFlavorMachine(flavor, details)
 	}
 
 	if config.Machine.MaxBuilds > 0 && details.UsedCount >= config.Machine.MaxBuilds {
@@ -237,13 +1592,33 @@ func (m *machineProvider) updateMachine(config *common.RunnerConfig, data *machi
 		return errors.New("Too many builds")
 	}
 
-	if data.Total() >= config.Limit && config.Limit > 0 {
+	if details.usedTooLong(config.Machine.MaxMachineUseTime) {
+		// Limit cumulative time spent running builds
+		return errors.New("Too long in use")
+	}
+
+	if data.Total() >= config.Limit+config.LimitBurst && config.Limit > 0 {
 		// Limit maximum number of machines
 		return errors.New("Too many machines")
 	}
 
-	if time.Since(details.Used) > time.Second*time.Duration(config.Machine.GetIdleTime()) {
-		if data.Idle >= config.Machine.GetIdleCount() {
+	idleTime := m.idleTime(config)
+	if details.Burst {
+		// Burst machines get no idle grace period, so they are scaled
+		// down as soon as demand drops
+		idleTime = 0
+	}
+
+	if time.Since(details.Used) > idleTime {
+		// The MinIdleCount floor keeps a few warm machines around even
+		// when the idle target aims for zero
+		if data.Idle >= m.idleCount(config) && data.Idle >= config.Machine.MinIdleCount {
+			// Park the machine at the stopped tier rather than paying
+			// for a fresh create when demand returns
+			if config.Machine.StopOnDownscale && details.State == machineStateIdle {
+				m.stop(details, "Too many idle machines")
+				return nil
+			}
 			// Remove machine that are way over the idle time
 			return errors.New("Too many idle machines")
 		}
@@ -251,10 +1626,89 @@ func (m *machineProvider) updateMachine(config *common.RunnerConfig, data *machi
 	return nil
 }
 
+// stop parks an idle machine in the Stopped state instead of removing
+// it; a machine that fails to stop is removed after all, as its state
+// on the cloud is then unknown
+func (m *machineProvider) stop(details *machineDetails, reason string) {
+	details.Reason = reason
+	m.setState(details, machineStateStopped)
+	details.logger().
+		Infoln("Stopping idle machine")
+
+	go func() {
+		err := m.guardDriverCall(details.Name, func() error {
+			return m.machine.Stop(details.Name, machineStopCommandTimeout)
+		})
+		if err != nil {
+			details.logger().
+				WithError(err).
+				Warningln("Failed to stop machine, removing it")
+			m.remove(details.Name, "Failed to stop")
+		}
+	}()
+}
+
+// restartStoppedMachine picks one stopped machine of a compatible shape
+// and brings it back: it sits in Creating while the backend starts it
+// and rejoins the idle pool once that succeeds. It reports whether a
+// restart was kicked off
+func (m *machineProvider) restartStoppedMachine(config *common.RunnerConfig) bool {
+	shape := machineShape(config)
+	filter := machineFilter(config)
+
+	var candidate *machineDetails
+	m.machines().each(func(details *machineDetails) {
+		if candidate != nil || details.State != machineStateStopped {
+			return
+		}
+		if details.Shape != shape || !matchesMachineFilter(details.Name, filter) {
+			return
+		}
+		candidate = details
+	})
+	if candidate == nil {
+		return false
+	}
+
+	m.setState(candidate, machineStateCreating)
+	candidate.Phase = machinePhaseConnectCheck
+	candidate.logger().
+		Infoln("Restarting stopped machine")
+
+	go func() {
+		err := m.guardDriverCall(candidate.Name, func() error {
+			return m.machine.Start(candidate.Name)
+		})
+		if err != nil {
+			m.remove(candidate.Name, "Failed to restart")
+			return
+		}
+		candidate.Used = time.Now()
+		m.setState(candidate, machineStateIdle)
+	}()
+	return true
+}
+
 func (m *machineProvider) updateMachines(machines []string, config *common.RunnerConfig) (data machinesData, validMachines []string) {
 	data.Runner = config.ShortDescription()
 	validMachines = make([]string, 0, len(machines))
 
+	// Update burst machines last, so that the limit checks remove them
+	// before the steady-state machines
+	steady := make([]string, 0, len(machines))
+	burst := make([]string, 0, len(machines))
+	for _, name := range machines {
+		if m.machineDetails(name, false).Burst {
+			burst = append(burst, name)
+		} else {
+			steady = append(steady, name)
+		}
+	}
+	prefer := removalComparatorFor(config.Machine.RemovalStrategy)
+	m.orderForRemoval(steady, prefer)
+	m.orderForRemoval(burst, prefer)
+	machines = append(steady, burst...)
+
 	for _, name := range machines {
 		details := m.machineDetails(name, false)
 		details.LastSeen = time.Now()
@@ -264,49 +1718,222 @@ func (m *machineProvider) updateMachines(machines []string, config *common.Runne
 			validMachines = append(validMachines, name)
 		} else {
 			m.remove(details.Name, err)
+			data.noteRemoval(err.Error())
 		}
 
-		data.Add(details)
+		// Flavored and reserved machines don't count against the main
+		// pool targets
+		if !details.Reserved && findFlavor(config, details.Shape) == nil {
+			data.Add(details)
+		}
 	}
 	return
 }
 
-func (m *machineProvider) createMachines(config *common.RunnerConfig, data *machinesData) {
+func (m *machineProvider) createMachines(config *common.RunnerConfig, data *machinesData) (created int) {
 	// Create a new machines and mark them as Idle
 	for {
-		if data.Available() >= config.Machine.GetIdleCount() {
+		if data.Available() >= m.idleCount(config) {
 			// Limit maximum number of idle machines
 			break
 		}
+
+		// Waking a stopped machine beats the cost and latency of a
+		// fresh create
+		if data.Stopped > 0 && m.restartStoppedMachine(config) {
+			data.Stopped--
+			data.Creating++
+			continue
+		}
 		if data.Total() >= config.Limit && config.Limit > 0 {
-			// Limit maximum number of machines
-			break
+			if data.Total() >= config.Limit+config.LimitBurst {
+				// Limit maximum number of machines
+				break
+			}
+
+			// Temporarily exceed the limit using the burst allowance
+			details, _ := m.create(config, machineStateIdle)
+			if details == nil {
+				// The creation breaker is open
+				break
+			}
+			details.Burst = true
+		} else {
+			if details, _ := m.create(config, machineStateIdle); details == nil {
+				break
+			}
 		}
-		m.create(config, machineStateIdle)
 		data.Creating++
+		created++
+	}
+
+	// Maintain the warm standby sub-pool, which is promoted only when a
+	// pool machine fails
+	for data.Standby < config.Machine.StandbyCount {
+		if data.Total() >= config.Limit && config.Limit > 0 {
+			break
+		}
+		if details, _ := m.create(config, machineStateStandby); details == nil {
+			break
+		}
+		data.Standby++
+		created++
+	}
+
+	// Each flavor scales towards its own idle target independently
+	m.createFlavorMachines(config)
+	return
+}
+
+// intermediateMachineList returns a list of machines that might not yet be
+// visible on the backend list; these are the machines between being
+// requested to create and the backend starting to list them
+func (m *machineProvider) intermediateMachineList(excludedMachines []string) []string {
+	var excludedSet map[string]struct{}
+	var intermediateMachines []string
+
+	m.machines().each(func(details *machineDetails) {
+		if details.State != machineStateCreating {
+			return
+		}
+
+		if excludedSet == nil {
+			// lazily convert to set, as most of the times this loop will not be executed
+			excludedSet = make(map[string]struct{}, len(excludedMachines))
+			for _, excludedMachine := range excludedMachines {
+				excludedSet[excludedMachine] = struct{}{}
+			}
+		}
+
+		if _, ok := excludedSet[details.Name]; ok {
+			return
+		}
+
+		intermediateMachines = append(intermediateMachines, details.Name)
+	})
+
+	return intermediateMachines
+}
+
+// listMachines returns the backend machine list, serving it from a
+// short-TTL cache. Concurrent callers block on the lock and then reuse
+// the result of the single backend call that went through
+func (m *machineProvider) listMachines() ([]string, error) {
+	m.listLock.Lock()
+	defer m.listLock.Unlock()
+
+	if m.listCached != nil && time.Since(m.listFetched) < listCacheTTL {
+		return append([]string(nil), m.listCached...), nil
 	}
+
+	machines, err := m.machine.List()
+	if err != nil {
+		return nil, err
+	}
+
+	m.listCached = append([]string(nil), machines...)
+	m.listFetched = time.Now()
+	return machines, nil
+}
+
+// invalidateListCache drops the cached backend list; it's called after
+// operations that change the list
+func (m *machineProvider) invalidateListCache() {
+	m.listLock.Lock()
+	defer m.listLock.Unlock()
+	m.listCached = nil
 }
 
 func (m *machineProvider) loadMachines(config *common.RunnerConfig) (machines []string, err error) {
-	machines, err = m.machine.List()
+	machines, err = m.listMachines()
 	if err != nil {
 		return nil, err
 	}
 
+	if m.DryRun {
+		machines = append(machines, m.syntheticMachineList(machines)...)
+	}
+
+	machines = append(machines, m.intermediateMachineList(machines)...)
 	machines = filterMachineList(machines, machineFilter(config))
 	return
 }
 
+// syntheticMachineList returns all tracked machines that the backend
+// doesn't know about; in dry-run mode these are the machines we only
+// pretended to create
+func (m *machineProvider) syntheticMachineList(excludedMachines []string) []string {
+	excluded := make(map[string]struct{}, len(excludedMachines))
+	for _, name := range excludedMachines {
+		excluded[name] = struct{}{}
+	}
+
+	var machines []string
+
+	m.machines().each(func(details *machineDetails) {
+		if details.State == machineStateRemoving {
+			return
+		}
+		if _, ok := excluded[details.Name]; ok {
+			return
+		}
+		machines = append(machines, details.Name)
+	})
+	return machines
+}
+
 func (m *machineProvider) Acquire(config *common.RunnerConfig) (data common.ExecutorData, err error) {
 	if config.Machine == nil || config.Machine.MachineName == "" {
 		err = fmt.Errorf("Missing Machine options")
 		return
 	}
 
+	if m.isClosed() {
+		err = errors.New("provider is closed")
+		return
+	}
+
+	if m.isDraining() {
+		err = errors.New("provider is draining")
+		return
+	}
+
+	m.applyMetricsLabels(config)
+
+	m.addAcquireWaiter(1)
+	defer m.addAcquireWaiter(-1)
+
 	// Lock updating machines, because two Acquires can be run at the same time
 	m.acquireLock.Lock()
 	defer m.acquireLock.Unlock()
 
+	// Fail fast when the docker-machine binary is missing or too old
+	if err = m.verifyBackend(config); err != nil {
+		return
+	}
+
+	// Isolate the machine store when the runner configures a custom one
+	if config.Machine.StoragePath != "" {
+		if machine, ok := m.machine.(storagePathSetter); ok {
+			machine.SetStoragePath(config.Machine.StoragePath)
+		}
+	}
+
+	// Apply the configured operation concurrency limits
+	if config.Machine.MaxCreateConcurrency > 0 {
+		m.createQueue.setSlots(config.Machine.MaxCreateConcurrency)
+	}
+	if config.Machine.MaxRemoveConcurrency > 0 {
+		m.removeQueue.setSlots(config.Machine.MaxRemoveConcurrency)
+	}
+	if config.Machine.MaxOperationConcurrency > 0 {
+		m.work.setBudget(config.Machine.MaxOperationConcurrency)
+	}
+	m.setQuarantineTime(time.Second * time.Duration(config.Machine.QuarantineTime))
+	m.setTeardownOrder(config.Machine.TeardownOrder)
+	m.setBuildsPerMachine(config.Machine.MaxConcurrentBuilds)
+	m.setMinIdleTarget(config.Machine.MinIdleCount)
+
 	machines, err := m.loadMachines(config)
 	if err != nil {
 		return
@@ -314,36 +1941,184 @@ func (m *machineProvider) Acquire(config *common.RunnerConfig) (data common.Exec
 
 	// Update a list of currently configured machines
 	machinesData, validMachines := m.updateMachines(machines, config)
+	m.trackUtilization(&machinesData)
+	m.recordPeakDemand(machinesData.Used)
 
 	// Pre-create machines
-	m.createMachines(config, &machinesData)
+	created := m.createMachines(config, &machinesData)
+	m.recordScalingDecision(config, &machinesData, created)
 
 	logrus.WithFields(machinesData.Fields()).
 		WithField("runner", config.ShortDescription()).
-		WithField("minIdleCount", config.Machine.GetIdleCount()).
+		WithField("minIdleCount", m.idleCount(config)).
 		WithField("maxMachines", config.Limit).
 		WithField("time", time.Now()).
 		Debugln("Docker Machine Details")
 	machinesData.writeDebugInformation()
 
 	// Try to find a free machine
-	details := m.findFreeMachine(false, validMachines...)
+	details := m.findFreeMachine(machineShape(config), affinityKey(config), false, validMachines...)
 	if details != nil {
 		data = details
 		return
 	}
 
 	// If we have a free machines we can process a build
-	if config.Machine.GetIdleCount() != 0 && machinesData.Idle == 0 {
-		err = errors.New("No free machines that can process builds")
+	if m.idleCount(config) != 0 && machinesData.Idle == 0 {
+		m.totalActions.WithLabelValues("refused").Inc()
+		m.capacity.markSaturated()
+		err = m.capacityError(config.Limit, &machinesData)
 	}
 	return
 }
 
+func (m *machineProvider) boundMachine(jobID int64) string {
+	m.jobBindingsLock.Lock()
+	defer m.jobBindingsLock.Unlock()
+	return m.jobBindings[jobID]
+}
+
+func (m *machineProvider) bindJob(jobID int64, name string) {
+	m.jobBindingsLock.Lock()
+	defer m.jobBindingsLock.Unlock()
+	if m.jobBindings == nil {
+		m.jobBindings = make(map[int64]string)
+	}
+	m.jobBindings[jobID] = name
+}
+
+func (m *machineProvider) unbindJob(jobID int64) {
+	m.jobBindingsLock.Lock()
+	defer m.jobBindingsLock.Unlock()
+	delete(m.jobBindings, jobID)
+}
+
+// AcquireForJob acquires a machine like Acquire, but binds it to the
+// given job ID: a retried acquire for the same job returns the machine
+// already bound to it instead of grabbing a second one. The binding is
+// cleared when the machine is released
+func (m *machineProvider) AcquireForJob(config *common.RunnerConfig, jobID int64) (common.ExecutorData, error) {
+	if name := m.boundMachine(jobID); name != "" {
+		if details := m.machines().get(name); details != nil && details.canBeUsed() {
+			return details, nil
+		}
+		// The bound machine is gone or already runs something else;
+		// fall through to a fresh acquire
+		m.unbindJob(jobID)
+	}
+
+	data, err := m.Acquire(config)
+	if details, ok := data.(*machineDetails); err == nil && ok && details != nil {
+		details.BoundJob = jobID
+		m.bindJob(jobID, details.Name)
+	}
+	return data, err
+}
+
+// maxQueueWait is how long an AcquireContext waiter holds out for a
+// released machine before falling back to an on-demand create
+func maxQueueWait(config *common.RunnerConfig) time.Duration {
+	wait := time.Duration(config.Machine.MaxQueueWait) * time.Second
+	if wait <= 0 {
+		wait = defaultMaxQueueWait
+	}
+	return wait
+}
+
+// hasCapacity tells whether this config's machines are still under its
+// Limit, not counting machines already on their way out
+func (m *machineProvider) hasCapacity(config *common.RunnerConfig) bool {
+	if config.Limit <= 0 {
+		return true
+	}
+
+	total := 0
+	filter := machineFilter(config)
+	m.machines().each(func(details *machineDetails) {
+		if details.State != machineStateRemoving && matchesMachineFilter(details.Name, filter) {
+			total++
+		}
+	})
+	return total < config.Limit
+}
+
+// AcquireContext blocks until a machine can serve the job, the context
+// is cancelled or the provider closes. It favors reuse over latency: a
+// fresh create is only attempted once the waiter has been blocked for
+// MaxQueueWait while the pool still has headroom under Limit; with the
+// Limit reached it keeps waiting for a release
+func (m *machineProvider) AcquireContext(ctx context.Context, config *common.RunnerConfig) (common.ExecutorData, error) {
+	if config.Machine == nil || config.Machine.MachineName == "" {
+		return nil, fmt.Errorf("Missing Machine options")
+	}
+
+	if m.isClosed() {
+		return nil, errors.New("provider is closed")
+	}
+
+	m.addAcquireWaiter(1)
+	defer m.addAcquireWaiter(-1)
+
+	ticket := m.waitQueue.enter()
+	defer m.waitQueue.leave(ticket)
+
+	progress := queueProgress(ctx)
+	lastPosition := 0
+
+	started := time.Now()
+	for {
+		if progress != nil {
+			if position := m.waitQueue.position(ticket); position != lastPosition {
+				lastPosition = position
+				select {
+				case progress <- position:
+				default:
+				}
+			}
+		}
+
+		machines, err := m.loadMachines(config)
+		if err != nil {
+			return nil, err
+		}
+		if details := m.findFreeMachine(machineShape(config), affinityKey(config), true, machines...); details != nil {
+			return details, nil
+		}
+
+		if time.Since(started) >= maxQueueWait(config) && m.hasCapacity(config) && !config.Machine.NoCreate {
+			details, errCh := m.create(config, machineStateAcquired)
+			if err = <-errCh; err == nil {
+				return details, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-m.done():
+			return nil, errors.New("provider is closed")
+		case <-time.After(acquireWaitInterval):
+		}
+	}
+}
+
 func (m *machineProvider) Use(config *common.RunnerConfig, data common.ExecutorData) (newConfig common.RunnerConfig, newData common.ExecutorData, err error) {
 	// Find a new machine
 	details, _ := data.(*machineDetails)
-	if details == nil || !details.canBeUsed() || !m.machine.CanConnect(details.Name, true) {
+
+	// A machine created under a different configuration (other flavor or
+	// driver option overrides) cannot run this job: send it back to its
+	// pool and find a compatible one instead
+	if details != nil && details.canBeUsed() && details.Shape != machineShape(config) {
+		details.logger().
+			Warningln("Machine does not match the current configuration")
+		m.Release(config, details)
+		details = nil
+	}
+
+	if details == nil || !details.canBeUsed() ||
+		(details.State == machineStateUsed && details.ActiveBuilds >= m.getBuildsPerMachine()) ||
+		!m.canConnectWithBackoff(config, details.Name, true) {
 		details, err = m.retryUseMachine(config)
 		if err != nil {
 			return
@@ -354,14 +2129,37 @@ func (m *machineProvider) Use(config *common.RunnerConfig, data common.ExecutorD
 	}
 
 	// Get machine credentials
-	dc, err := m.machine.Credentials(details.Name)
+	var dc docker_helpers.DockerCredentials
+	err = m.guardDriverCall(details.Name, func() (err error) {
+		dc, err = m.machine.Credentials(details.Name)
+		return
+	})
+	if err == nil {
+		err = validateCredentials(dc)
+		m.recordMachineError(details.Name, err)
+	}
 	if err != nil {
+		if m.handleCredentialFailure(config, details) {
+			newData = nil
+			return
+		}
 		if newData != nil {
 			m.Release(config, newData)
 		}
 		newData = nil
 		return
 	}
+	details.CredentialFailures = 0
+	if details.Node == "" {
+		details.Node = dc.Host
+	}
+
+	// A stale TLS cert would only surface later as an opaque connect
+	// failure; refresh or retire the machine up front instead
+	if err = m.ensureCertFreshness(details, dc); err != nil {
+		newData = nil
+		return
+	}
 
 	// Create shallow copy of config and store in it docker credentials
 	newConfig = *config
@@ -372,31 +2170,129 @@ func (m *machineProvider) Use(config *common.RunnerConfig, data common.ExecutorD
 	newConfig.Docker.DockerCredentials = dc
 
 	// Mark machine as used
-	details.State = machineStateUsed
+	if details.State != machineStateUsed {
+		m.setState(details, machineStateUsed)
+	}
 	details.Used = time.Now()
-	details.UsedCount++
+	if config.Machine == nil || config.Machine.CountBuildsAt != "finish" {
+		details.UsedCount++
+	}
+	details.ActiveBuilds++
+	if key := affinityKey(config); key != "" {
+		details.LastProject = key
+	}
 	m.totalActions.WithLabelValues("used").Inc()
 	return
 }
 
+// ReportBuildResult records the outcome of a build that ran on the
+// machine. Failures accumulate while they are consecutive and a success
+// clears them; once the configured streak is reached the next release
+// removes the machine, as a host that fails everything it is given is
+// usually corrupted
+func (m *machineProvider) ReportBuildResult(data common.ExecutorData, success bool) {
+	details, ok := data.(*machineDetails)
+	if !ok {
+		return
+	}
+
+	if success {
+		details.FailedBuilds = 0
+		return
+	}
+	details.FailedBuilds++
+}
+
 func (m *machineProvider) Release(config *common.RunnerConfig, data common.ExecutorData) {
+	m.release(config, data, false)
+}
+
+// ReleaseAndRemove releases the machine like Release, but sends it
+// straight to removal instead of back to the idle pool. It's meant for
+// machines that a build left in a dirty or corrupted state
+func (m *machineProvider) ReleaseAndRemove(config *common.RunnerConfig, data common.ExecutorData) {
+	m.release(config, data, true)
+}
+
+func (m *machineProvider) release(config *common.RunnerConfig, data common.ExecutorData, forceRemove bool) {
 	// Release machine
 	details, ok := data.(*machineDetails)
 	if ok {
+		// A second Release for the same machine must not touch counters
+		// or re-apply the cooldown: treat it as a logged no-op
+		if details.State == machineStateIdle {
+			details.logger().
+				Warningln("Machine was already released")
+			return
+		}
+
+		if details.BoundJob != 0 {
+			m.unbindJob(details.BoundJob)
+			details.BoundJob = 0
+		}
+
 		// Mark last used time when is Used
 		if details.State == machineStateUsed {
+			m.recordBuildDuration(time.Since(details.Used))
+			details.UsedTime += time.Since(details.Used)
 			details.Used = time.Now()
+			if details.ActiveBuilds > 0 {
+				details.ActiveBuilds--
+			}
+			// In the "finish" mode a build only counts against MaxBuilds
+			// once it has run to completion
+			if config != nil && config.Machine != nil && config.Machine.CountBuildsAt == "finish" {
+				details.UsedCount++
+			}
 		}
 
-		// Remove machine if we already used it
-		if config != nil && config.Machine != nil &&
-			config.Machine.MaxBuilds > 0 && details.UsedCount >= config.Machine.MaxBuilds {
-			err := m.remove(details.Name, "Too many builds")
-			if err == nil {
+		// Other builds still run on the machine: removal and rotation
+		// wait until the last of them releases it
+		if details.ActiveBuilds > 0 {
+			return
+		}
+
+		// Reserved machines always return to idle, no matter how worn out
+		// or dirty a build left them
+		if !details.Reserved {
+			// Remove machine if the build left it dirty
+			if forceRemove {
+				m.remove(details.Name, "Released dirty")
 				return
 			}
+
+			// Remove machine if we already used it
+			if config != nil && config.Machine != nil &&
+				config.Machine.MaxBuilds > 0 && details.UsedCount >= config.Machine.MaxBuilds {
+				err := m.remove(details.Name, "Too many builds")
+				if err == nil {
+					return
+				}
+			}
+
+			// Remove machine that keeps failing its builds
+			if config != nil && config.Machine != nil && config.Machine.MaxBuildFailures > 0 &&
+				details.FailedBuilds >= config.Machine.MaxBuildFailures {
+				err := m.remove(details.Name, "Too many consecutive build failures")
+				if err == nil {
+					return
+				}
+			}
+
+			// Remove machine that spent too much of its lifetime running builds
+			if config != nil && config.Machine != nil && details.usedTooLong(config.Machine.MaxMachineUseTime) {
+				err := m.remove(details.Name, "Too long in use")
+				if err == nil {
+					return
+				}
+			}
+		}
+		if config != nil && config.Machine != nil && config.Machine.ReleaseCooldown > 0 {
+			details.CooldownUntil = time.Now().Add(time.Second * time.Duration(config.Machine.ReleaseCooldown))
 		}
-		details.State = machineStateIdle
+		m.setState(details, machineStateIdle)
+		m.emitEvent(MachineEventReleased, details.Name, "")
+		m.capacity.notifyAvailable()
 	}
 }
 
@@ -418,44 +2314,35 @@ func (m *machineProvider) Create() common.Executor {
 	}
 }
 
+// NewMachineProvider returns an executor provider that uses the given
+// Machine implementation to provision machines instead of the default
+// docker-machine helper, which allows to plug in a custom provisioning
+// backend.
+func NewMachineProvider(name, executor string, machine docker_helpers.Machine) common.ExecutorProvider {
+	provider := newMachineProvider(name, executor)
+	provider.machine = machine
+	return provider
+}
+
 func newMachineProvider(name, executor string) *machineProvider {
 	provider := common.GetExecutor(executor)
 	if provider == nil {
 		logrus.Panicln("Missing", executor)
 	}
 
-	return &machineProvider{
-		name:     name,
-		details:  make(machinesDetails),
-		machine:  docker_helpers.NewMachineCommand(),
-		provider: provider,
-		totalActions: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "gitlab_runner_autoscaling_actions_total",
-				Help: "The total number of actions executed by the provider.",
-				ConstLabels: prometheus.Labels{
-					"executor": name,
-				},
-			},
-			[]string{"action"},
-		),
-		currentStatesDesc: prometheus.NewDesc(
-			"gitlab_runner_autoscaling_machine_states",
-			"The current number of machines per state in this provider.",
-			[]string{"state"},
-			prometheus.Labels{
-				"executor": name,
-			},
-		),
-		creationHistogram: prometheus.NewHistogram(
-			prometheus.HistogramOpts{
-				Name:    "gitlab_runner_autoscaling_machine_creation_duration_seconds",
-				Help:    "Histogram of machine creation time.",
-				Buckets: prometheus.ExponentialBuckets(30, 1.25, 10),
-				ConstLabels: prometheus.Labels{
-					"executor": name,
-				},
-			},
-		),
+	p := &machineProvider{
+		name:          name,
+		details:       newDetailsStore(machineDetailsShards),
+		machine:       docker_helpers.NewMachineCommand(),
+		provider:      provider,
+		connectProbes: make(chan struct{}, maxConcurrentConnectProbes),
+		removalAudit:  newRemovalAudit(removalAuditSize),
+		deadLetters:   newDeadLetterList(deadLetterSize),
+		decisionTrace: newDecisionTrace(decisionTraceSize),
+		createQueue:   newOperationQueue(maxConcurrentCreates),
+		removeQueue:   newOperationQueue(maxConcurrentRemoves),
+		work:          newWorkPool(maxConcurrentOperations),
 	}
+	p.buildMetrics(prometheus.Labels{"executor": name})
+	return p
 }
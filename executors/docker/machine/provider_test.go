@@ -1,6 +1,7 @@
 package machine
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -8,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"gitlab.com/gitlab-org/gitlab-runner/common"
 	"gitlab.com/gitlab-org/gitlab-runner/helpers/docker"
@@ -88,25 +90,146 @@ func createMachineOffPeakIdleConfig(offPeakPeriod string) *common.RunnerConfig {
 type testMachine struct {
 	machines []string
 	second   bool
+	collided bool
 
 	Created chan bool
 	Removed chan bool
 	Stopped chan bool
 
+	StoragePath    string
+	ConnectCalls   int
+	CreateCalls    int
+	ListCalls      int
+	StartCalls     int
+	LastCreateOpts []string
+
+	// flakyConnects is the number of CanConnect failures left for
+	// "flaky-connect" machines
+	flakyConnects int
+
+	// broken lists machines that stopped answering CanConnect at some
+	// point of the test, e.g. to simulate a spot reclamation
+	broken []string
+
+	// flakyProvisions is the number of failures left for
+	// "flaky-provision" machines before they come up successfully
+	flakyProvisions int
+
+	// flakyRemoved tracks whether the one-off Remove failure of a
+	// "remove-flaky" machine was already consumed
+	flakyRemoved bool
+
+	// regenerated records the machines whose TLS certificates were
+	// rebuilt via Regenerate
+	regenerated []string
+
+	// createDelay slows every Create call down, e.g. to let a test
+	// deadline fire while a machine is still being brought up
+	createDelay time.Duration
+
+	// version is what Version reports; empty skips the startup check.
+	// binaryPath records the binary override applied via SetBinary
+	version    string
+	versionErr error
+	binaryPath string
+
+	// driver is what DriverName reports for every machine
+	driver string
+
+	// connectDelay slows every CanConnect probe down, so that tests can
+	// observe how many probes run at once
+	connectDelay          time.Duration
+	connectConcurrency    int
+	maxConnectConcurrency int
+
+	createConcurrency    int
+	maxCreateConcurrency int
+	removeConcurrency    int
+	maxRemoveConcurrency int
+
 	mutex sync.Mutex
 }
 
+func (m *testMachine) SetBinary(path string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.binaryPath = path
+}
+
+func (m *testMachine) Version() (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.version, m.versionErr
+}
+
+func (m *testMachine) DriverName(name string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.driver == "" {
+		return "test", nil
+	}
+	return m.driver, nil
+}
+
+func (m *testMachine) Regenerate(name string) error {
+	if strings.Contains(name, "regen-fail") {
+		return errors.New("failed to regenerate certs")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.regenerated = append(m.regenerated, name)
+	return nil
+}
+
+func (m *testMachine) SetStoragePath(path string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.StoragePath = path
+}
+
 func (m *testMachine) Create(driver, name string, opts ...string) error {
+	m.mutex.Lock()
+	m.LastCreateOpts = opts
+	m.CreateCalls++
+	m.createConcurrency++
+	if m.createConcurrency > m.maxCreateConcurrency {
+		m.maxCreateConcurrency = m.createConcurrency
+	}
+	delay := m.createDelay
+	m.mutex.Unlock()
+
+	if delay <= 0 {
+		delay = time.Millisecond
+	}
+	time.Sleep(delay)
+
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	m.createConcurrency--
 
 	if strings.Contains(name, "second-fail") {
 		if !m.second {
 			m.second = true
 			return errors.New("Failed to create")
 		}
+	} else if strings.Contains(name, "detailed-fail") {
+		return errors.New("Failed to create: VBoxManage: error: Details: code E_FAIL")
 	} else if strings.Contains(name, "create-fail") || strings.Contains(name, "provision-fail") {
 		return errors.New("Failed to create")
+	} else if strings.Contains(name, "name-collision") {
+		if !m.collided {
+			m.collided = true
+			return errors.New("Host already exists")
+		}
+	} else if strings.Contains(name, "flaky-provision") && m.flakyProvisions > 0 {
+		m.flakyProvisions--
+		return errors.New("Failed to create")
 	}
 	m.machines = append(m.machines, name)
 	m.Created <- true
@@ -121,16 +244,47 @@ func (m *testMachine) Provision(name string) error {
 	if strings.Contains(name, "provision-fail") || strings.Contains(name, "second-fail") {
 		return errors.New("Failed to provision")
 	}
+	if strings.Contains(name, "flaky-provision") && m.flakyProvisions > 0 {
+		m.flakyProvisions--
+		return errors.New("Failed to provision")
+	}
+	if strings.Contains(name, "detailed-fail") {
+		return errors.New("Failed to create: VBoxManage: error: Details: code E_FAIL")
+	}
 	m.machines = append(m.machines, name)
 	return nil
 }
 
 func (m *testMachine) Stop(name string, timeout time.Duration) error {
+	m.mutex.Lock()
+	m.removeConcurrency++
+	if m.removeConcurrency > m.maxRemoveConcurrency {
+		m.maxRemoveConcurrency = m.removeConcurrency
+	}
+	m.mutex.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	m.mutex.Lock()
+	m.removeConcurrency--
+	m.mutex.Unlock()
+
 	m.Stopped <- true
 
 	return nil
 }
 
+func (m *testMachine) Start(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if strings.Contains(name, "start-fail") {
+		return errors.New("Failed to start")
+	}
+	m.StartCalls++
+	return nil
+}
+
 func (m *testMachine) Remove(name string) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -138,6 +292,10 @@ func (m *testMachine) Remove(name string) error {
 	if name == "remove-fail" {
 		return errors.New("failed to remove")
 	}
+	if strings.Contains(name, "remove-flaky") && !m.flakyRemoved {
+		m.flakyRemoved = true
+		return errors.New("temporarily unavailable")
+	}
 	var machines []string
 	for _, machine := range m.machines {
 		if machine != name {
@@ -166,45 +324,93 @@ func (m *testMachine) List() (machines []string, err error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	m.ListCalls++
 	return m.machines, nil
 }
 
 func (m *testMachine) CanConnect(name string, skipCache bool) bool {
+	m.mutex.Lock()
+	m.ConnectCalls++
+	m.connectConcurrency++
+	if m.connectConcurrency > m.maxConnectConcurrency {
+		m.maxConnectConcurrency = m.connectConcurrency
+	}
+	delay := m.connectDelay
+	m.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.connectConcurrency--
+
+	if strings.Contains(name, "flaky-connect") && m.flakyConnects > 0 {
+		m.flakyConnects--
+		return false
+	}
+
 	if strings.Contains(name, "no-can-connect") {
 		return false
 	}
+
+	if strings.Contains(name, "panic-connect") {
+		panic("broken machine driver")
+	}
+
+	for _, broken := range m.broken {
+		if broken == name {
+			return false
+		}
+	}
 	return true
 }
 
+// markBroken makes the named machine stop answering CanConnect, as if
+// its host was reclaimed under it
+func (m *testMachine) markBroken(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.broken = append(m.broken, name)
+}
+
 func (m *testMachine) Credentials(name string) (dc docker_helpers.DockerCredentials, err error) {
 	if strings.Contains(name, "no-connect") {
 		err = errors.New("Failed to connect")
+		return
+	}
+	if strings.Contains(name, "empty-credentials") {
+		return
 	}
+	dc.Host = "tcp://" + name + ":2376"
 	return
 }
 
-func countIdleMachines(p *machineProvider) (count int) {
-	p.lock.RLock()
-	defer p.lock.RUnlock()
-
-	for _, details := range p.details {
-		if details.State == machineStateIdle {
+func countMachinesInState(p *machineProvider, state machineState) (count int) {
+	p.machines().each(func(details *machineDetails) {
+		if details.State == state {
 			count++
 		}
-	}
+	})
 	return
 }
 
+func countIdleMachines(p *machineProvider) int {
+	return countMachinesInState(p, machineStateIdle)
+}
+
 func assertIdleMachines(t *testing.T, p *machineProvider, expected int, msgAndArgs ...interface{}) bool {
 	var idle int
-	for i := 0; i < 10; i++ {
+	for i := 0; i < 100; i++ {
 		idle = countIdleMachines(p)
 
 		if expected == idle {
 			return true
 		}
 
-		time.Sleep(50 * time.Microsecond)
+		time.Sleep(time.Millisecond)
 	}
 
 	result := fmt.Sprintf("should have %d idle, but has %d", expected, idle)
@@ -213,27 +419,24 @@ func assertIdleMachines(t *testing.T, p *machineProvider, expected int, msgAndAr
 }
 
 func countTotalMachines(p *machineProvider) (count int) {
-	p.lock.RLock()
-	defer p.lock.RUnlock()
-
-	for _, details := range p.details {
+	p.machines().each(func(details *machineDetails) {
 		if details.State != machineStateRemoving {
 			count++
 		}
-	}
+	})
 	return
 }
 
 func assertTotalMachines(t *testing.T, p *machineProvider, expected int, msgAndArgs ...interface{}) bool {
 	var total int
-	for i := 0; i < 10; i++ {
+	for i := 0; i < 100; i++ {
 		total = countTotalMachines(p)
 
 		if expected == total {
 			return true
 		}
 
-		time.Sleep(50 * time.Microsecond)
+		time.Sleep(time.Millisecond)
 	}
 
 	result := fmt.Sprintf("should have %d total, but has %d", expected, total)
@@ -253,6 +456,26 @@ func testMachineProvider(machine ...string) (*machineProvider, *testMachine) {
 	return p, t
 }
 
+func TestNewMachineProvider(t *testing.T) {
+	tm := &testMachine{
+		machines: []string{"test-machine"},
+		Created:  make(chan bool, 10),
+		Removed:  make(chan bool, 10),
+		Stopped:  make(chan bool, 10),
+	}
+	p := NewMachineProvider("docker+machine", "docker", tm)
+
+	d, err := p.Acquire(machineDefaultConfig)
+	assert.NoError(t, err)
+	assert.NotNil(t, d, "acquires a machine through the custom Machine backend")
+
+	p.Release(machineDefaultConfig, d)
+
+	d2, err := p.Acquire(machineDefaultConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, d, d2, "acquires the released machine")
+}
+
 func TestMachineDetails(t *testing.T) {
 	p, _ := testMachineProvider()
 	m1 := p.machineDetails("test", false)
@@ -276,202 +499,2027 @@ func TestMachineDetails(t *testing.T) {
 
 func TestMachineFindFree(t *testing.T) {
 	p, tm := testMachineProvider("no-can-connect")
-	d1 := p.findFreeMachine(false)
+	d1 := p.findFreeMachine("", "", false)
 	assert.Nil(t, d1, "no machines, return nil")
 
-	d2 := p.findFreeMachine(false, "machine1")
+	d2 := p.findFreeMachine("", "", false, "machine1")
 	assert.NotNil(t, d2, "acquire one machine")
 
-	d3 := p.findFreeMachine(false, "machine1")
+	d3 := p.findFreeMachine("", "", false, "machine1")
 	assert.Nil(t, d3, "fail to acquire that machine")
 
-	d4 := p.findFreeMachine(false, "machine1", "machine2")
+	d4 := p.findFreeMachine("", "", false, "machine1", "machine2")
 	assert.NotNil(t, d4, "acquire a new machine")
 	assert.NotEqual(t, d2, d4, "and it's a different machine")
 
 	assert.Len(t, tm.machines, 1, "has one machine")
-	d5 := p.findFreeMachine(false, "machine1", "no-can-connect")
+	d5 := p.findFreeMachine("", "", false, "machine1", "no-can-connect")
 	assert.Nil(t, d5, "fails to acquire machine to which he can't connect")
 }
 
-func TestMachineCreationAndRemoval(t *testing.T) {
-	provisionRetryInterval = 0
+func TestMachineDriverPanic(t *testing.T) {
+	p, _ := testMachineProvider("panic-connect-preset")
 
-	p, _ := testMachineProvider()
-	d, errCh := p.create(machineDefaultConfig, machineStateUsed)
-	assert.NotNil(t, d)
-	assert.NoError(t, <-errCh)
-	assert.Equal(t, machineStateUsed, d.State)
-	assert.Equal(t, 0, d.UsedCount)
-	assert.NotNil(t, p.details[d.Name])
+	config := createMachineConfig(1, 5)
+	config.Machine.MachineName = "panic-connect-%s"
 
-	d2, errCh := p.create(machineProvisionFail, machineStateUsed)
-	assert.NotNil(t, d2)
-	assert.Error(t, <-errCh, "Fails, because it fails to provision machine")
-	assert.Equal(t, machineStateRemoving, d2.State)
+	assert.NotPanics(t, func() {
+		_, err := p.Acquire(config)
+		assert.NoError(t, err)
 
-	d3, errCh := p.create(machineCreateFail, machineStateUsed)
-	assert.NotNil(t, d3)
-	assert.NoError(t, <-errCh)
-	assert.Equal(t, machineStateUsed, d3.State)
+		_, err = p.Acquire(config)
+		assert.Error(t, err, "the panicking machine should be treated as unreachable")
+	}, "a driver panic must not take down the provider")
+}
 
-	p.remove(d.Name)
-	assert.Equal(t, machineStateRemoving, d.State)
+func TestMachineFindFreeStableOrder(t *testing.T) {
+	p, _ := testMachineProvider("machine-a", "machine-b", "machine-c")
+
+	d := p.findFreeMachine("", "", false, "machine-b", "machine-c", "machine-a")
+	assert.NotNil(t, d)
+	assert.Equal(t, "machine-c", d.Name, "it should pick the newest machine by name")
+	d.State = machineStateIdle
+
+	d = p.findFreeMachine("", "", false, "machine-c", "machine-a", "machine-b")
+	assert.NotNil(t, d)
+	assert.Equal(t, "machine-c", d.Name, "the selection should not depend on the candidate order")
 }
 
-func TestMachineUse(t *testing.T) {
-	provisionRetryInterval = 0
+func TestMachineProjectAffinity(t *testing.T) {
+	p, _ := testMachineProvider("machine-a", "machine-b", "machine-c")
 
-	p, _ := testMachineProvider("machine1")
+	p.machineDetails("machine-a", false).LastProject = "7"
 
-	d1, err := p.useMachine(machineDefaultConfig)
-	assert.NotNil(t, d1)
-	assert.NoError(t, err)
-	assert.Equal(t, machineStateAcquired, d1.State)
-	assert.Equal(t, "machine1", d1.Name, "finds a free machine1")
+	d := p.findFreeMachine("", "7", false, "machine-a", "machine-b", "machine-c")
+	assert.NotNil(t, d)
+	assert.Equal(t, "machine-a", d.Name, "it should prefer the machine that last ran the project")
 
-	d2, err := p.useMachine(machineDefaultConfig)
-	assert.NotNil(t, d2)
-	assert.NoError(t, err)
-	assert.Equal(t, machineStateAcquired, d2.State)
-	assert.NotEqual(t, "machine1", d2.Name, "creates a new machine")
+	d = p.findFreeMachine("", "7", false, "machine-a", "machine-b", "machine-c")
+	assert.NotNil(t, d)
+	assert.Equal(t, "machine-c", d.Name, "it should fall back to any free machine when the affine one is busy")
 
-	_, err = p.useMachine(machineProvisionFail)
-	assert.Error(t, err, "fails to create a new machine")
+	d = p.findFreeMachine("", "9", false, "machine-b")
+	assert.NotNil(t, d)
+	assert.Equal(t, "machine-b", d.Name, "an unknown project should still get a free machine")
 }
 
-func TestMachineTestRetry(t *testing.T) {
-	provisionRetryInterval = 0
-
+func TestMachineGlobalLimit(t *testing.T) {
 	p, _ := testMachineProvider()
-	_, err := p.useMachine(machineSecondFail)
-	assert.Error(t, err, "fails to create a new machine")
 
-	p, _ = testMachineProvider()
-	d1, err := p.retryUseMachine(machineSecondFail)
-	assert.NoError(t, err, "after replying the same test scenario and using retry it succeeds")
-	assert.Equal(t, machineStateAcquired, d1.State)
+	config1 := createMachineConfig(3, 0)
+	config1.Machine.MaxTotalMachines = 4
+
+	config2 := createMachineConfig(3, 0)
+	config2.Machine.MachineName = "other-machine-%s"
+	config2.Machine.MaxTotalMachines = 4
+
+	p.Acquire(config1)
+	assertTotalMachines(t, p, 3, "the first config should fill its idle target")
+
+	p.Acquire(config2)
+	assertTotalMachines(t, p, 4, "the second config should be stopped at the global ceiling")
+
+	p.Acquire(config2)
+	assertTotalMachines(t, p, 4, "the ceiling should keep holding across sweeps")
 }
 
-func TestMachineAcquireAndRelease(t *testing.T) {
-	p, _ := testMachineProvider("test-machine")
+func TestMachineReleaseCooldown(t *testing.T) {
+	p, _ := testMachineProvider("machine1")
+	config := createMachineConfig(1, 5)
+	config.Machine.ReleaseCooldown = 30
 
-	d1, err := p.Acquire(machineDefaultConfig)
-	assert.NoError(t, err)
-	assert.NotNil(t, d1, "acquires machine")
+	d := p.findFreeMachine("", "", false, "machine1")
+	assert.NotNil(t, d)
+	p.Release(config, d)
 
-	d2, _ := p.Acquire(machineDefaultConfig)
-	assert.Nil(t, d2, "fails to acquire a machine")
+	assert.Equal(t, machineStateIdle, d.State)
+	assert.Nil(t, p.findFreeMachine("", "", false, "machine1"),
+		"a cooling machine should not be selectable")
 
-	p.Release(machineDefaultConfig, d1)
+	// Fast-forward past the cooldown
+	d.CooldownUntil = time.Now().Add(-time.Second)
+	assert.NotNil(t, p.findFreeMachine("", "", false, "machine1"),
+		"the machine should be selectable again once the cooldown elapsed")
+}
 
-	d3, err := p.Acquire(machineDefaultConfig)
-	assert.NoError(t, err)
-	assert.Equal(t, d1, d3, "acquires released machine")
+func TestScalingIntervalJitter(t *testing.T) {
+	config := createMachineConfig(0, 1)
+	config.Machine.ScalingInterval = 10
+	config.Machine.ScalingJitter = 5
+
+	varied := false
+	first := nextScalingInterval(config)
+	for i := 0; i < 100; i++ {
+		interval := nextScalingInterval(config)
+		assert.True(t, interval >= 10*time.Second, "the tick should never undercut the base interval")
+		assert.True(t, interval < 15*time.Second, "the tick should stay within the jitter band")
+		if interval != first {
+			varied = true
+		}
+	}
+	assert.True(t, varied, "successive ticks should not all be identical")
 }
 
-func TestMachineOnDemandMode(t *testing.T) {
+func TestMachineScaleTo(t *testing.T) {
 	p, _ := testMachineProvider()
+	config := createMachineConfig(1, 5)
+	config.Limit = 4
 
-	config := createMachineConfig(0, 1)
-	_, err := p.Acquire(config)
-	assert.NoError(t, err)
+	assert.NoError(t, p.ScaleTo(config, 3))
+	assertIdleMachines(t, p, 3, "the pool should jump straight to the requested target")
+
+	// The configured limit still caps a forced scale-up
+	assert.NoError(t, p.ScaleTo(config, 10))
+	assertIdleMachines(t, p, 4)
+	assertTotalMachines(t, p, 4)
+
+	// Scaling down retires the surplus idle machines immediately
+	assert.NoError(t, p.ScaleTo(config, 1))
+	assertIdleMachines(t, p, 1)
+
+	// Another runner config shares the provider: its idle machines must
+	// survive a scale-down of this config
+	foreign := p.machineDetails("other-runner-1", false)
+	assert.NoError(t, p.ScaleTo(config, 0))
+	assertIdleMachines(t, p, 1, "only this config's machines should be retired")
+	assert.Equal(t, machineStateIdle, foreign.State, "the other runner's machine must be left alone")
+
+	assert.Error(t, p.ScaleTo(config, -1), "a negative target should be rejected")
 }
 
-func TestMachinePreCreateMode(t *testing.T) {
-	p, m := testMachineProvider()
+func TestMachineIdleConnectCheck(t *testing.T) {
+	provisionRetryInterval = 0
 
+	p, _ := testMachineProvider()
 	config := createMachineConfig(1, 5)
-	d, err := p.Acquire(config)
-	assert.Error(t, err, "it should fail with message that currently there's no free machines")
-	assert.Nil(t, d)
+	config.Machine.MachineName = "no-can-connect-%s"
 
-	<-m.Created
-	assertIdleMachines(t, p, 1, "it should contain exactly one machine")
+	_, errCh := p.create(config, machineStateIdle)
+	assert.Error(t, <-errCh)
+	assertIdleMachines(t, p, 0, "an unreachable machine must never appear as idle")
+	assertTotalMachines(t, p, 0)
 
-	d, err = p.Acquire(config)
-	assert.NoError(t, err, "it should be ready to process builds")
-	assertIdleMachines(t, p, 0, "it should acquire the free node")
-	p.Release(config, d)
-	assertIdleMachines(t, p, 1, "after releasing it should have one free node")
+	config.Machine.MachineName = "no-connect-%s"
+	_, errCh = p.create(config, machineStateIdle)
+	assert.Error(t, <-errCh, "failing credential verification should abort the create")
+	assertIdleMachines(t, p, 0)
+}
 
-	config = createMachineConfig(2, 5)
-	d, err = p.Acquire(config)
-	assert.NoError(t, err)
-	p.Release(config, d)
+func TestMachineShouldRemoveHook(t *testing.T) {
+	p, _ := testMachineProvider("old-template-1", "new-template-1")
+	p.ShouldRemove = func(details *machineDetails) (bool, string) {
+		return strings.Contains(details.Name, "old-template"), "deprecated machine template"
+	}
 
-	<-m.Created
-	assertIdleMachines(t, p, 2, "it should start creating a second machine")
+	config := createMachineConfig(2, 100)
+	_, validMachines := p.updateMachines([]string{"old-template-1", "new-template-1"}, config)
+	assert.Equal(t, []string{"new-template-1"}, validMachines)
+	assertTotalMachines(t, p, 1, "only the machines matched by the hook should be removed")
 
-	config = createMachineConfig(1, 0)
-	config.Limit = 1
-	d, err = p.Acquire(config)
-	assert.NoError(t, err)
-	p.Release(config, d)
+	entries := p.RemovalAudit()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "old-template-1", entries[0].Name)
+	assert.Equal(t, "deprecated machine template", entries[0].Reason)
+}
 
-	<-m.Stopped
-	<-m.Removed
-	assertIdleMachines(t, p, 1, "it should downscale to single machine")
+func TestMachinePreAcquireHook(t *testing.T) {
+	p, _ := testMachineProvider("machine1", "machine2")
+	p.machineDetails("machine1", false)
+	p.machineDetails("machine2", false)
 
-	d, err = p.Acquire(config)
-	assert.NoError(t, err, "we should acquire single machine")
+	// machine2 is the newest and would normally win the selection; the
+	// hook vetoes it and the selection must move on to machine1
+	p.PreAcquire = func(details *machineDetails) error {
+		if details.Name == "machine2" {
+			return errors.New("required mount is missing")
+		}
+		return nil
+	}
 
-	_, err = p.Acquire(config)
-	assert.Error(t, err, "it should fail with message that currently there's no free machines")
-	p.Release(config, d)
-	assertIdleMachines(t, p, 1, "it should leave one idle")
+	details := p.findFreeMachine("", "", false, "machine1", "machine2")
+	assert.NotNil(t, details)
+	if details == nil {
+		return
+	}
+	assert.Equal(t, "machine1", details.Name)
+
+	rejected := p.machineDetails("machine2", false)
+	assert.Equal(t, machineStateIdle, rejected.State, "a rejected machine should return to the pool")
+	assertTotalMachines(t, p, 2, "the hook should not remove machines")
 }
 
-func TestMachineLimitMax(t *testing.T) {
-	p, _ := testMachineProvider()
+func TestMachineAdoptionRetry(t *testing.T) {
+	adoptionRetryInterval = 0
 
-	config := createMachineConfig(10, 5)
-	config.Limit = 5
+	p, tm := testMachineProvider("flaky-connect")
+	tm.flakyConnects = 2
 
-	d, err := p.Acquire(config)
-	assert.Error(t, err, "it should fail with message that currently there's no free machines")
-	assert.Nil(t, d)
-	assertIdleMachines(t, p, 5, "it should contain exactly a maximum of 5 nodes")
+	assert.NoError(t, p.Reconcile())
 
-	config.Limit = 8
-	d, err = p.Acquire(config)
-	p.Release(config, d)
-	assertIdleMachines(t, p, 8, "it should upscale to 8 nodes")
+	// The machine becomes reachable on a later probe and joins the pool
+	assertIdleMachines(t, p, 1, "a briefly unreachable machine should be adopted as idle")
 
-	config.Limit = 2
-	d, err = p.Acquire(config)
-	p.Release(config, d)
-	assertIdleMachines(t, p, 2, "it should downscale to 2 nodes")
+	p2, _ := testMachineProvider("no-can-connect")
+	assert.NoError(t, p2.Reconcile())
+	assertTotalMachines(t, p2, 0, "a permanently unreachable machine should be removed")
 }
 
-func TestMachineMaxBuildsForExistingMachines(t *testing.T) {
-	provisionRetryInterval = 0
+func TestMachineAdoptionConcurrency(t *testing.T) {
+	defer func(old int) { adoptionConcurrency = old }(adoptionConcurrency)
+	adoptionConcurrency = 4
 
-	p, _ := testMachineProvider("remove-fail")
-	config := createMachineConfig(1, 5)
-	config.Machine.MaxBuilds = 1
-	d, err := p.Acquire(config)
-	assert.Error(t, err)
-	assert.Nil(t, d)
+	names := make([]string, 30)
+	for i := range names {
+		names[i] = fmt.Sprintf("existing-%d", i)
+	}
+	p, tm := testMachineProvider(names...)
+	tm.connectDelay = time.Millisecond
+
+	assert.NoError(t, p.Reconcile())
+	assert.True(t, tm.maxConnectConcurrency <= 4,
+		"adoption probes should respect their cap, got %d", tm.maxConnectConcurrency)
+	assert.True(t, tm.maxConnectConcurrency > 1, "adoption probes should run in parallel")
+	assertIdleMachines(t, p, 30, "every reachable machine should be adopted as idle")
 }
 
-func TestMachineMaxBuilds(t *testing.T) {
-	config := createMachineConfig(1, 5)
-	p, _ := testMachineProvider(newMachineName(config))
-	config.Machine.MaxBuilds = 2 // by default we set it to 1
-	d, err := p.Acquire(config)
-	assert.NoError(t, err)
-	assert.NotNil(t, d)
+func TestMachineMinIdleFloor(t *testing.T) {
+	p, _ := testMachineProvider("machine1", "machine2", "machine3")
+	config := createMachineConfig(0, 0)
+	config.Machine.MinIdleCount = 1
 
-	_, nd, err := p.Use(config, d)
-	assert.NoError(t, err)
-	assert.Nil(t, nd, "we passed the data, we should not get the data now")
+	for _, name := range []string{"machine1", "machine2", "machine3"} {
+		details := p.machineDetails(name, false)
+		details.Used = time.Now().Add(-time.Hour)
+	}
 
-	p.Release(config, d)
+	_, validMachines := p.updateMachines([]string{"machine1", "machine2", "machine3"}, config)
+	assert.Equal(t, []string{"machine1"}, validMachines)
+	assertTotalMachines(t, p, 1, "downscaling should stop at the MinIdleCount floor")
 
-	dd := d.(*machineDetails)
-	assert.Equal(t, machineStateRemoving, dd.State, "the machine should be removed due to too many builds")
-	assert.Equal(t, "Too many builds", dd.Reason, "the machine should be removed due to too many builds")
+	p.machineDetails("machine1", false).Used = time.Now().Add(-time.Hour)
+	p.updateMachines([]string{"machine1"}, config)
+	assertTotalMachines(t, p, 1, "the floor machine should survive further sweeps")
+}
+
+type testCredentialProvider struct {
+	options []string
+	err     error
+	calls   int
+}
+
+func (c *testCredentialProvider) GetCredentialOptions() ([]string, error) {
+	c.calls++
+	return c.options, c.err
+}
+
+func TestMachineCredentialProvider(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, tm := testMachineProvider()
+	credentials := &testCredentialProvider{options: []string{"amazonec2-access-key=AKIA123"}}
+	p.CredentialProvider = credentials
+
+	config := createMachineConfig(0, 1)
+	_, errCh := p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, 1, credentials.calls, "credentials should be fetched before each create")
+	assert.Contains(t, tm.LastCreateOpts, "amazonec2-access-key=AKIA123")
+
+	credentials.err = errors.New("vault is sealed")
+	_, errCh = p.create(config, machineStateIdle)
+	assert.Error(t, <-errCh)
+	assertTotalMachines(t, p, 1, "a failed credential fetch should abort the create cleanly")
+}
+
+func TestMachineAcquireTimeout(t *testing.T) {
+	p, tm := testMachineProvider()
+	tm.createDelay = 1200 * time.Millisecond
+
+	config := createMachineConfig(0, 1)
+	config.Machine.AcquireTimeout = 1
+
+	started := time.Now()
+	_, _, err := p.Use(config, nil)
+	assert.Equal(t, errAcquireTimedOut, err)
+	assert.True(t, time.Since(started) < 2*time.Second, "the deadline should cut the slow create short without retries")
+	assertTotalMachines(t, p, 0, "the half-created machine should be cleaned up")
+}
+
+func TestMachineProvisionRetryInPlace(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, tm := testMachineProvider()
+	tm.flakyProvisions = 2
+
+	config := createMachineConfig(0, 1)
+	config.Machine.MachineName = "flaky-provision-%s"
+	config.Machine.ProvisionRetryMode = "inplace"
+
+	_, errCh := p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, 1, tm.CreateCalls, "in-place mode should re-provision the created host instead of recreating it")
+	assertTotalMachines(t, p, 1)
+}
+
+func TestMachineProvisionRetryReplace(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, tm := testMachineProvider()
+	tm.flakyProvisions = 1
+
+	config := createMachineConfig(0, 1)
+	config.Machine.MachineName = "flaky-provision-%s"
+	config.Machine.ProvisionRetryMode = "replace"
+
+	_, errCh := p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, 2, tm.CreateCalls, "replace mode should start over with a fresh machine")
+	assertTotalMachines(t, p, 1)
+}
+
+func TestMachineAttemptsCounter(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, _ := testMachineProvider()
+	config := createMachineConfig(0, 1)
+	config.Machine.MachineName = "name-collision-%s"
+
+	details, errCh := p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, 2, details.Attempts, "the collision retry should show up as a second attempt")
+
+	config.Machine.MachineName = "test-machine-%s"
+	details, errCh = p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, 1, details.Attempts, "a clean create is a single attempt")
+}
+
+func TestMachineAcquireContextQueueWait(t *testing.T) {
+	defaultMaxQueueWait = 5 * time.Millisecond
+	acquireWaitInterval = time.Millisecond
+
+	p, _ := testMachineProvider()
+	config := createMachineConfig(0, 5)
+	config.Limit = 2
+
+	busy := p.machineDetails(newMachineName(config), false)
+	busy.State = machineStateUsed
+
+	data, err := p.AcquireContext(context.Background(), config)
+	assert.NoError(t, err, "spare capacity under the limit should let the waiter fall back to a create")
+	details, ok := data.(*machineDetails)
+	if assert.True(t, ok) {
+		assert.NotEqual(t, busy.Name, details.Name, "the waiter should get a freshly created machine")
+		assert.Equal(t, machineStateAcquired, details.State)
+	}
+
+	// With the limit reached the waiter keeps holding out for a release
+	config.Limit = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = p.AcquireContext(ctx, config)
+	assert.Equal(t, context.DeadlineExceeded, err, "a full pool should keep the waiter blocked until the context expires")
+}
+
+func TestMachineAcquireContextQueuePosition(t *testing.T) {
+	acquireWaitInterval = time.Millisecond
+
+	p, _ := testMachineProvider()
+	config := createMachineConfig(0, 5)
+	config.Limit = 1
+
+	// A busy machine exhausts the limit, so every waiter queues
+	busy := p.machineDetails(newMachineName(config), false)
+	busy.State = machineStateUsed
+
+	ctxs := make([]context.CancelFunc, 3)
+	progress := make([]chan int, 3)
+	done := make([]chan error, 3)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		ctxs[i] = cancel
+		progress[i] = make(chan int, 10)
+		done[i] = make(chan error, 1)
+		go func(i int, ctx context.Context) {
+			_, err := p.AcquireContext(WithQueueProgress(ctx, progress[i]), config)
+			done[i] <- err
+		}(i, ctx)
+
+		// Wait for the initial report before starting the next waiter,
+		// so the arrival order is deterministic
+		select {
+		case position := <-progress[i]:
+			assert.Equal(t, i+1, position, "each waiter should join at the back of the queue")
+		case <-time.After(time.Second):
+			t.Fatalf("waiter %d never reported its position", i)
+		}
+	}
+
+	// The front waiter leaves: the others move up one place each
+	ctxs[0]()
+	assert.Equal(t, context.Canceled, <-done[0])
+	for i := 1; i < 3; i++ {
+		select {
+		case position := <-progress[i]:
+			assert.Equal(t, i, position, "waiters should move up when the front one leaves")
+		case <-time.After(time.Second):
+			t.Fatalf("waiter %d never saw the queue shrink", i)
+		}
+	}
+
+	for i := 1; i < 3; i++ {
+		ctxs[i]()
+		assert.Equal(t, context.Canceled, <-done[i])
+	}
+}
+
+func TestMachineTemplatedOptions(t *testing.T) {
+	p, tm := testMachineProvider()
+
+	config := createMachineConfig(0, 1)
+	config.Environment = []string{"Region=us-east-1"}
+	config.Machine.MachineOptions = []string{"--amazonec2-region={{.Region}}", "--amazonec2-monitoring"}
+
+	_, errCh := p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+	assert.Contains(t, tm.LastCreateOpts, "--amazonec2-region=us-east-1", "template tokens should be rendered before Create")
+	assert.Contains(t, tm.LastCreateOpts, "--amazonec2-monitoring", "plain options should pass through untouched")
+
+	// A token without a matching environment variable aborts the create
+	// instead of producing a machine with a mangled option
+	config.Machine.MachineOptions = []string{"--amazonec2-zone={{.Zone}}"}
+	_, errCh = p.create(config, machineStateIdle)
+	assert.Error(t, <-errCh)
+}
+
+func TestMachineEmptyCredentials(t *testing.T) {
+	p, _ := testMachineProvider("empty-credentials")
+
+	config := createMachineConfig(0, 5)
+	config.Machine.MachineName = "empty-credentials-%s"
+
+	_, newData, err := p.Use(config, nil)
+	assert.Error(t, err, "credentials without a host should be treated as a connect failure")
+	assert.Nil(t, newData)
+
+	details := p.machineDetails("empty-credentials", false)
+	assert.Equal(t, machineStateIdle, details.State, "the machine should be released, not handed out")
+}
+
+func TestMachineProviderClose(t *testing.T) {
+	p, _ := testMachineProvider("machine1")
+
+	// Keep a machine busy, so that the drain loop has to wait
+	busy := p.machineDetails("machine1", false)
+	busy.State = machineStateUsed
+
+	drainDone := make(chan struct{})
+	go func() {
+		defer close(drainDone)
+		p.Drain(time.Hour, false)
+	}()
+
+	assert.NoError(t, p.Close())
+	assert.NoError(t, p.Close(), "Close should be idempotent")
+
+	select {
+	case <-drainDone:
+	case <-time.After(time.Second):
+		t.Fatal("the drain loop did not exit on Close")
+	}
+
+	_, err := p.Acquire(createMachineConfig(0, 1))
+	assert.EqualError(t, err, "provider is closed")
+}
+
+func TestMachineMaxConcurrentBuilds(t *testing.T) {
+	p, _ := testMachineProvider("machine1")
+	config := createMachineConfig(0, 1)
+	config.Machine.MaxConcurrentBuilds = 2
+	p.setBuildsPerMachine(config.Machine.MaxConcurrentBuilds)
+
+	d1 := p.findFreeMachine("", "", false, "machine1")
+	assert.NotNil(t, d1)
+	_, _, err := p.Use(config, d1)
+	assert.NoError(t, err)
+
+	d2 := p.findFreeMachine("", "", false, "machine1")
+	assert.NotNil(t, d2, "a used machine with spare capacity should be acquirable")
+	assert.Equal(t, d1, d2)
+	_, _, err = p.Use(config, d2)
+	assert.NoError(t, err)
+
+	d3 := p.findFreeMachine("", "", false, "machine1")
+	assert.Nil(t, d3, "a machine at its build concurrency should be excluded")
+
+	p.Release(config, d1)
+	assert.Equal(t, machineStateUsed, d1.State, "the machine should stay used while a build is active")
+
+	d4 := p.findFreeMachine("", "", false, "machine1")
+	assert.NotNil(t, d4, "a release should free build capacity again")
+	_, _, err = p.Use(config, d4)
+	assert.NoError(t, err)
+
+	p.Release(config, d1)
+	p.Release(config, d1)
+	assert.Equal(t, machineStateIdle, d1.State, "the last release should return the machine to idle")
+}
+
+func TestMachineReleaseTwice(t *testing.T) {
+	p, _ := testMachineProvider("machine1")
+	config := createMachineConfig(1, 5)
+
+	d := p.findFreeMachine("", "", false, "machine1")
+	assert.NotNil(t, d)
+	_, _, err := p.Use(config, d)
+	assert.NoError(t, err)
+
+	p.Release(config, d)
+	assert.Equal(t, machineStateIdle, d.State)
+	assert.Equal(t, 0, d.ActiveBuilds)
+	usedCount := d.UsedCount
+	usedTime := d.UsedTime
+
+	// A retried Release must leave the machine exactly as the first one did
+	p.Release(config, d)
+	assert.Equal(t, machineStateIdle, d.State)
+	assert.Equal(t, 0, d.ActiveBuilds, "the build counter should never go below zero")
+	assert.Equal(t, usedCount, d.UsedCount)
+	assert.Equal(t, usedTime, d.UsedTime)
+}
+
+func TestMachineCreationTimeout(t *testing.T) {
+	p, _ := testMachineProvider("queued", "fast", "slow")
+	config := createMachineConfig(0, 5)
+	config.Machine.CreationTimeout = 10
+
+	// Waiting in the creation queue for a long time is fine; the
+	// provisioning timer only starts once the machine leaves the queue
+	queued := p.machineDetails("queued", false)
+	queued.State = machineStateCreating
+	queued.Created = time.Now().Add(-time.Minute)
+
+	fast := p.machineDetails("fast", false)
+	fast.State = machineStateCreating
+	fast.Created = time.Now().Add(-time.Minute)
+	fast.ProvisionStarted = time.Now()
+
+	slow := p.machineDetails("slow", false)
+	slow.State = machineStateCreating
+	slow.ProvisionStarted = time.Now().Add(-time.Minute)
+
+	_, validMachines := p.updateMachines([]string{"queued", "fast", "slow"}, config)
+	assert.Contains(t, validMachines, "queued", "queue wait should not count against the creation timeout")
+	assert.Contains(t, validMachines, "fast")
+	assert.NotContains(t, validMachines, "slow")
+	assertTotalMachines(t, p, 2, "the machine stuck in provisioning should be removed")
+}
+
+func TestMachineEvents(t *testing.T) {
+	p, _ := testMachineProvider()
+	events := p.Events()
+
+	config := createMachineConfig(0, 1)
+	details, errCh := p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+
+	d := p.findFreeMachine("", "", false, details.Name)
+	assert.NotNil(t, d)
+
+	p.Release(nil, d)
+	p.remove(details.Name, "cycle done")
+
+	expected := []MachineEventType{
+		MachineEventCreated,
+		MachineEventAcquired,
+		MachineEventReleased,
+		MachineEventRemoved,
+	}
+	for _, eventType := range expected {
+		select {
+		case event := <-events:
+			assert.Equal(t, eventType, event.Type)
+			assert.Equal(t, details.Name, event.Machine)
+			assert.False(t, event.Time.IsZero())
+			if eventType == MachineEventRemoved {
+				assert.Equal(t, "cycle done", event.Reason)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no", eventType, "event arrived")
+		}
+	}
+
+	// A slow consumer must never stall the provider: overflowing events
+	// are dropped instead
+	for i := 0; i < machineEventBufferSize+10; i++ {
+		p.emitEvent(MachineEventReleased, "overflow", "")
+	}
+}
+
+func TestMachineNoCreate(t *testing.T) {
+	p, _ := testMachineProvider()
+	config := createMachineConfig(0, 1)
+	config.Machine.NoCreate = true
+
+	_, err := p.retryUseMachine(config)
+	assert.Error(t, err, "an empty pool should fail fast instead of creating")
+	assertTotalMachines(t, p, 0, "it should not create a machine on demand")
+
+	config.Machine.NoCreate = false
+	details, err := p.retryUseMachine(config)
+	assert.NoError(t, err, "on-demand creation should remain the default")
+	assert.NotNil(t, details)
+}
+
+func TestMachineListCache(t *testing.T) {
+	p, tm := testMachineProvider("machine1", "machine2")
+
+	for i := 0; i < 5; i++ {
+		machines, err := p.listMachines()
+		assert.NoError(t, err)
+		assert.Len(t, machines, 2)
+	}
+	assert.Equal(t, 1, tm.ListCalls, "rapid calls should collapse to one backend call")
+
+	p.invalidateListCache()
+	_, err := p.listMachines()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tm.ListCalls, "an invalidated cache should be refetched")
+}
+
+func TestMachineUtilization(t *testing.T) {
+	p := &machineProvider{}
+
+	// An idle machine that accumulated 25s of build time over 100s
+	idle := p.machineDetails("machine-idle", false)
+	idle.Created = time.Now().Add(-100 * time.Second)
+	idle.UsedTime = 25 * time.Second
+
+	// A machine that accumulated 20s and has been running a build for
+	// another 30s of its 100s lifetime
+	used := p.machineDetails("machine-used", false)
+	used.Created = time.Now().Add(-100 * time.Second)
+	used.UsedTime = 20 * time.Second
+	used.State = machineStateUsed
+	used.Used = time.Now().Add(-30 * time.Second)
+
+	machines, poolUsedFraction := p.Utilization()
+	assert.Len(t, machines, 2)
+
+	fractions := make(map[string]float64, len(machines))
+	for _, usage := range machines {
+		fractions[usage.Name] = usage.UsedFraction
+	}
+	assert.InDelta(t, 0.25, fractions["machine-idle"], 0.01)
+	assert.InDelta(t, 0.5, fractions["machine-used"], 0.01)
+	assert.InDelta(t, 0.375, poolUsedFraction, 0.01, "the pool fraction should be weighted by lifetime")
+}
+
+func TestMachineAgeDistribution(t *testing.T) {
+	p := &machineProvider{}
+
+	ages := map[string]time.Duration{
+		"fresh-machine":   time.Minute,
+		"warm-machine":    30 * time.Minute,
+		"daily-machine":   2 * time.Hour,
+		"ancient-machine": 24 * time.Hour,
+	}
+	for name, age := range ages {
+		details := p.machineDetails(name, false)
+		details.Created = time.Now().Add(-age)
+	}
+
+	buckets := p.AgeDistribution()
+	if assert.Len(t, buckets, len(machineAgeBuckets)+1) {
+		counts := make([]int, 0, len(buckets))
+		for _, bucket := range buckets {
+			counts = append(counts, bucket.Count)
+		}
+		assert.Equal(t, []int{1, 1, 1, 0, 1}, counts, "each machine should land in the bucket matching its age")
+		assert.Equal(t, time.Duration(0), buckets[len(buckets)-1].UpTo, "the last bucket is unbounded")
+	}
+}
+
+func TestMachineEffectiveConfig(t *testing.T) {
+	p := &machineProvider{}
+	config := createMachineConfig(5, 60)
+	config.Limit = 10
+
+	effective := p.EffectiveConfig(config)
+	assert.Equal(t, 5, effective.IdleCount)
+	assert.Equal(t, 60*time.Second, effective.IdleTime)
+	assert.Equal(t, 10, effective.Limit)
+
+	// An always-on off-peak window replaces the regular idle settings
+	config.Machine.OffPeakPeriods = []string{"* * * * * * *"}
+	config.Machine.OffPeakIdleCount = 1
+	config.Machine.OffPeakIdleTime = 30
+	assert.NoError(t, config.Machine.CompileOffPeakPeriods())
+
+	effective = p.EffectiveConfig(config)
+	assert.Equal(t, 1, effective.IdleCount, "the effective idle count should follow the off-peak window")
+	assert.Equal(t, 30*time.Second, effective.IdleTime, "the effective idle time should follow the off-peak window")
+	assert.Equal(t, 10, effective.Limit)
+}
+
+func TestMachineCredentialFailurePolicy(t *testing.T) {
+	p, _ := testMachineProvider("no-connect-1")
+
+	config := createMachineConfig(0, 5)
+	config.Machine.MachineName = "no-connect-%s"
+	config.Machine.MaxCredentialFailures = 2
+
+	_, newData, err := p.Use(config, nil)
+	assert.Error(t, err)
+	assert.Nil(t, newData)
+
+	details := p.machines().get("no-connect-1")
+	if assert.NotNil(t, details) {
+		assert.Equal(t, machineStateIdle, details.State, "below the threshold the machine should go back to idle")
+		assert.Equal(t, 1, details.CredentialFailures)
+	}
+
+	_, _, err = p.Use(config, nil)
+	assert.Error(t, err)
+	assertTotalMachines(t, p, 0, "hitting the threshold should remove the machine instead of releasing it")
+}
+
+func TestMachineRemoveByReason(t *testing.T) {
+	p, _ := testMachineProvider("sick1", "sick2", "busy", "other")
+
+	sick1 := p.machineDetails("sick1", false)
+	sick1.State = machineStateQuarantine
+	sick1.Reason = "bad image"
+
+	sick2 := p.machineDetails("sick2", false)
+	sick2.State = machineStateQuarantine
+	sick2.Reason = "bad image"
+
+	busy := p.machineDetails("busy", false)
+	busy.State = machineStateUsed
+	busy.Reason = "bad image"
+
+	other := p.machineDetails("other", false)
+	other.State = machineStateQuarantine
+	other.Reason = "disk full"
+
+	removed := p.RemoveByReason("bad image")
+	assert.Equal(t, 2, removed, "only the matching non-used machines should be scheduled for removal")
+
+	assert.Equal(t, machineStateUsed, busy.State, "a machine running a build is left to finish")
+	assert.Equal(t, machineStateQuarantine, other.State, "machines with a different reason are untouched")
+	assertTotalMachines(t, p, 2, "the sick machines should disappear from the pool")
+}
+
+func TestMachineDrainByVersion(t *testing.T) {
+	p, _ := testMachineProvider("old1", "old2", "old-busy", "new1")
+
+	old1 := p.machineDetails("old1", false)
+	old1.RunnerVersion = "11.0.0"
+
+	old2 := p.machineDetails("old2", false)
+	old2.RunnerVersion = "11.0.0"
+
+	oldBusy := p.machineDetails("old-busy", false)
+	oldBusy.RunnerVersion = "11.0.0"
+	oldBusy.State = machineStateUsed
+
+	new1 := p.machineDetails("new1", false)
+	new1.RunnerVersion = "12.0.0"
+
+	removed := p.DrainByVersion("11.0.0")
+	assert.Equal(t, 2, removed, "only the idle machines of the old version should be scheduled")
+
+	assert.Equal(t, machineStateUsed, oldBusy.State, "an old machine running a build is left to finish")
+	assert.Equal(t, machineStateIdle, new1.State, "machines of other versions are untouched")
+	assertTotalMachines(t, p, 2, "the idle old-version machines should disappear from the pool")
+
+	// Once the busy machine finishes its build, a later drain picks it up
+	oldBusy.State = machineStateIdle
+	removed = p.DrainByVersion("11.0.0")
+	assert.Equal(t, 1, removed)
+	assertTotalMachines(t, p, 1)
+}
+
+func TestMachineReserved(t *testing.T) {
+	p, _ := testMachineProvider("reserved", "disposable")
+	config := createMachineConfig(0, 0)
+
+	p.machineDetails("reserved", false)
+	p.machineDetails("disposable", false)
+	p.Reserve("reserved")
+
+	data, validMachines := p.updateMachines([]string{"reserved", "disposable"}, config)
+	assert.Equal(t, []string{"reserved"}, validMachines, "a scale-to-zero sweep should only keep the reserved machine")
+	assert.Equal(t, 0, data.Idle, "reserved machines should not count against the idle-removal math")
+
+	details := p.machines().get("reserved")
+	if assert.NotNil(t, details) {
+		assert.Equal(t, machineStateIdle, details.State)
+	}
+
+	p.Unreserve("reserved")
+	_, validMachines = p.updateMachines([]string{"reserved"}, config)
+	assert.Empty(t, validMachines, "an unreserved machine should age out again")
+}
+
+func TestMachineQuarantine(t *testing.T) {
+	p, _ := testMachineProvider("no-can-connect")
+	p.setQuarantineTime(30 * time.Second)
+
+	d := p.findFreeMachine("", "", false, "no-can-connect")
+	assert.Nil(t, d)
+
+	details := p.machineDetails("no-can-connect", false)
+	assert.Equal(t, machineStateQuarantine, details.State, "a failed machine should be parked, not removed")
+
+	d = p.findFreeMachine("", "", false, "no-can-connect")
+	assert.Nil(t, d, "a quarantined machine should not be acquired")
+
+	config := createMachineConfig(0, 1)
+	config.Machine.QuarantineTime = 30
+	data, validMachines := p.updateMachines([]string{"no-can-connect"}, config)
+	assert.Len(t, validMachines, 1)
+	assert.Zero(t, data.Idle, "a quarantined machine should not count as idle")
+	assert.Zero(t, data.Total(), "a quarantined machine should not count toward the limit")
+	assert.Equal(t, 1, data.Quarantined)
+
+	// Backdate the quarantine entry past its TTL; the next sweep should
+	// remove the machine
+	details.Used = time.Now().Add(-time.Minute)
+	p.updateMachines([]string{"no-can-connect"}, config)
+	assertTotalMachines(t, p, 0, "the machine should be removed after the quarantine TTL")
+}
+
+func TestMachineShapeIsolation(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(1, 5)
+	config.Machine.OverridableOptions = []string{"instance-type"}
+	config.Machine.MachineOptions = []string{"instance-type=small"}
+
+	_, err := p.Acquire(config)
+	assert.Error(t, err)
+	assertIdleMachines(t, p, 1, "it should create a default-shape idle machine")
+
+	shaped := applyMachineShape(config, common.JobVariables{
+		{Key: "MACHINE_OPTION_INSTANCE_TYPE", Value: "large"},
+	})
+	assert.NotEqual(t, config, shaped)
+	assert.Equal(t, "instance-type=large", shaped.Machine.MachineShape)
+	assert.Contains(t, shaped.Machine.MachineOptions, "instance-type=large")
+	assert.NotContains(t, shaped.Machine.MachineOptions, "instance-type=small")
+
+	unchanged := applyMachineShape(config, common.JobVariables{})
+	assert.Equal(t, config, unchanged, "without overrides the config is passed through")
+
+	_, nd, err := p.Use(shaped, nil)
+	assert.NoError(t, err)
+	details := nd.(*machineDetails)
+	assert.Equal(t, "instance-type=large", details.Shape, "the new machine should carry the requested shape")
+	assert.Equal(t, 1, countIdleMachines(p), "the default-shape idle machine should not be given to the shaped job")
+}
+
+func TestMachineRemoveUnknown(t *testing.T) {
+	p, tm := testMachineProvider("machine1")
+
+	err := p.remove("nonexistent")
+	assert.Error(t, err, "it should report the unknown machine")
+	assert.Zero(t, p.machines().len(), "it should not track the unknown machine")
+
+	d, err := p.Acquire(machineDefaultConfig)
+	assert.NoError(t, err)
+	assert.NotNil(t, d, "existing machines are untouched")
+	assert.Len(t, tm.machines, 1)
+}
+
+func TestMachineFindFreeProbesOnlyUntilFirstHealthy(t *testing.T) {
+	machines := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		machines = append(machines, fmt.Sprintf("machine%d", i))
+	}
+	p, tm := testMachineProvider(machines...)
+
+	d := p.findFreeMachine("", "", false, machines...)
+	assert.NotNil(t, d, "acquires a machine")
+	assert.Equal(t, 1, tm.ConnectCalls, "it should stop probing after the first healthy machine")
+}
+
+func TestMachineRemovalAudit(t *testing.T) {
+	p, _ := testMachineProvider("machine1", "machine2")
+
+	p.machineDetails("machine1", false)
+	p.machineDetails("machine2", false)
+	p.remove("machine1", "Too many builds")
+	p.remove("machine2", "machine is unavailable")
+
+	entries := p.RemovalAudit()
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "machine1", entries[0].Name)
+	assert.Equal(t, "Too many builds", entries[0].Reason)
+	assert.Equal(t, "machine2", entries[1].Name)
+	assert.Equal(t, "machine is unavailable", entries[1].Reason)
+}
+
+func TestMachineRemovalAuditIsBounded(t *testing.T) {
+	p, _ := testMachineProvider("machine1", "machine2")
+	p.removalAudit = newRemovalAudit(1)
+
+	p.machineDetails("machine1", false)
+	p.machineDetails("machine2", false)
+	p.remove("machine1", "Too many builds")
+	p.remove("machine2", "machine is unavailable")
+
+	entries := p.RemovalAudit()
+	assert.Len(t, entries, 1, "it should keep only the configured number of entries")
+	assert.Equal(t, "machine2", entries[0].Name, "it should keep the newest entry")
+}
+
+func TestMachineReconcile(t *testing.T) {
+	p, _ := testMachineProvider("existing-machine")
+
+	// Tracked, but no longer on the backend list
+	p.machineDetails("stale-machine", false)
+
+	// Mid-build machine that disappeared from the backend list
+	used := p.machineDetails("used-machine", false)
+	used.State = machineStateUsed
+
+	err := p.Reconcile()
+	assert.NoError(t, err)
+
+	assert.Nil(t, p.machines().get("stale-machine"), "it drops entries whose machines no longer exist")
+	assert.NotNil(t, p.machines().get("used-machine"), "it doesn't disturb machines mid-build")
+
+	adopted := p.machines().get("existing-machine")
+	assert.NotNil(t, adopted, "it adopts unknown machines")
+	assert.Equal(t, machineStateIdle, adopted.State)
+}
+
+func TestMachineCreateNameCollision(t *testing.T) {
+	provisionRetryInterval = 0
+
+	config := createMachineConfig(0, 5)
+	config.Machine.MachineName = "name-collision-%s"
+
+	p, tm := testMachineProvider()
+	d, errCh := p.create(config, machineStateUsed)
+	assert.NoError(t, <-errCh, "the creation should succeed with the re-rolled name")
+	assert.True(t, tm.collided, "the first name should have collided")
+
+	assert.Len(t, tm.machines, 1)
+	assert.Equal(t, d.Name, tm.machines[0], "the machine should exist under the fresh name")
+	assert.NotNil(t, p.machines().get(d.Name), "the machine should be tracked under the fresh name")
+	assert.Equal(t, 1, p.machines().len(), "the colliding name should no longer be tracked")
+}
+
+func TestMachineCreationPhases(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, tm := testMachineProvider()
+	d, errCh := p.create(machineCreateFail, machineStateIdle)
+	assert.Equal(t, machinePhaseCreate, d.Phase, "a machine starts in the create phase")
+
+	assert.NoError(t, <-errCh, "the fallback provisioning should succeed")
+	assert.True(t, d.RetryCount > 0, "the machine should have gone through the provision phase")
+	assert.Equal(t, 1, tm.ConnectCalls, "the machine should have gone through the connect-check phase")
+	assert.Equal(t, machinePhaseReady, d.Phase, "a provisioned machine ends up in the ready phase")
+}
+
+func TestMachineDetailsSharding(t *testing.T) {
+	store := newDetailsStore(8)
+
+	shards := make(map[*detailsShard]struct{})
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("machine%d", i)
+		shard := store.shard(name)
+		shards[shard] = struct{}{}
+
+		shard.lock.Lock()
+		shard.details[name] = &machineDetails{Name: name, State: machineStateIdle}
+		shard.lock.Unlock()
+	}
+	assert.True(t, len(shards) > 1, "the machines should spread across the shards")
+	assert.Equal(t, 100, store.len())
+
+	count := 0
+	store.each(func(details *machineDetails) {
+		count++
+	})
+	assert.Equal(t, 100, count, "each should visit every machine exactly once")
+
+	store.remove("machine0")
+	assert.Nil(t, store.get("machine0"))
+	assert.NotNil(t, store.get("machine1"))
+	assert.Equal(t, 99, store.len())
+
+	store.sweep(func(details *machineDetails) bool {
+		return details.Name == "machine1"
+	})
+	assert.Nil(t, store.get("machine1"))
+	assert.Equal(t, 98, store.len())
+}
+
+func BenchmarkMachineDetails(b *testing.B) {
+	p, _ := testMachineProvider()
+
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("benchmark-machine-%d", i)
+		p.machineDetails(names[i], false)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			p.machineDetails(names[i%len(names)], false)
+			i++
+		}
+	})
+}
+
+func TestMachineCreationAndRemoval(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, _ := testMachineProvider()
+	d, errCh := p.create(machineDefaultConfig, machineStateUsed)
+	assert.NotNil(t, d)
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, machineStateUsed, d.State)
+	assert.Equal(t, 0, d.UsedCount)
+	assert.NotNil(t, p.machines().get(d.Name))
+
+	d2, errCh := p.create(machineProvisionFail, machineStateUsed)
+	assert.NotNil(t, d2)
+	assert.Error(t, <-errCh, "Fails, because it fails to provision machine")
+	assert.Equal(t, machineStateRemoving, d2.State)
+
+	d3, errCh := p.create(machineCreateFail, machineStateUsed)
+	assert.NotNil(t, d3)
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, machineStateUsed, d3.State)
+
+	p.remove(d.Name)
+	assert.Equal(t, machineStateRemoving, d.State)
+}
+
+func TestMachineCreationPriority(t *testing.T) {
+	p, tm := testMachineProvider()
+	p.createQueue = newOperationQueue(1)
+
+	// Occupy the only creation slot, so both requests have to queue
+	p.createQueue.acquire(false)
+
+	background := createMachineConfig(0, 1)
+	background.Machine.MachineName = "background-%s"
+	onDemand := createMachineConfig(0, 1)
+	onDemand.Machine.MachineName = "on-demand-%s"
+
+	_, bgErrCh := p.create(background, machineStateIdle)
+	_, odErrCh := p.create(onDemand, machineStateAcquired)
+
+	for i := 0; i < 100 && p.createQueue.waiting() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 2, p.createQueue.waiting(), "both creations should be queued")
+
+	p.createQueue.release()
+	assert.NoError(t, <-odErrCh)
+	assert.NoError(t, <-bgErrCh)
+
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	assert.Contains(t, tm.machines[0], "on-demand", "the on-demand machine should be created first")
+	assert.Contains(t, tm.machines[1], "background", "the background machine should be created last")
+}
+
+func TestMachineSeparateCreateAndRemoveConcurrency(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, tm := testMachineProvider()
+	p.createQueue = newOperationQueue(2)
+	p.removeQueue = newOperationQueue(1)
+
+	// Refill: request many creations at once
+	config := createMachineConfig(0, 1)
+	names := make([]string, 0, 5)
+	errChs := make([]chan error, 0, 5)
+	for i := 0; i < 5; i++ {
+		d, errCh := p.create(config, machineStateIdle)
+		names = append(names, d.Name)
+		errChs = append(errChs, errCh)
+	}
+	for _, errCh := range errChs {
+		assert.NoError(t, <-errCh)
+	}
+
+	// Downscale: remove them all at once
+	for _, name := range names {
+		assert.NoError(t, p.remove(name, "downscale"))
+	}
+	for i := 0; i < 5; i++ {
+		<-tm.Removed
+	}
+
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	assert.True(t, tm.maxCreateConcurrency <= 2, "creates should respect their cap, got %d", tm.maxCreateConcurrency)
+	assert.True(t, tm.maxRemoveConcurrency <= 1, "removes should respect their cap, got %d", tm.maxRemoveConcurrency)
+}
+
+func TestMachineDryRun(t *testing.T) {
+	p, tm := testMachineProvider()
+	p.DryRun = true
+
+	config := createMachineConfig(2, 0)
+	_, err := p.Acquire(config)
+	assert.Error(t, err, "it should fail with message that currently there's no free machines")
+	assertIdleMachines(t, p, 2, "it should pretend to scale to IdleCount")
+
+	d, err := p.Acquire(config)
+	assert.NoError(t, err)
+	assert.NotNil(t, d, "it should hand out a synthetic machine")
+	p.Release(config, d)
+
+	config = createMachineConfig(0, 0)
+	_, err = p.Acquire(config)
+	assert.NoError(t, err)
+	assertIdleMachines(t, p, 0, "it should pretend to scale down")
+
+	assert.Empty(t, tm.machines, "no machine creation hit the backend")
+	assert.Len(t, tm.Created, 0)
+	assert.Len(t, tm.Removed, 0)
+
+	actions := p.DryRunActions()
+	assert.Equal(t, 2, actions["create"])
+	assert.Equal(t, 2, actions["remove"])
+}
+
+func TestMachineUse(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, _ := testMachineProvider("machine1")
+
+	d1, err := p.useMachine(machineDefaultConfig, time.Time{})
+	assert.NotNil(t, d1)
+	assert.NoError(t, err)
+	assert.Equal(t, machineStateAcquired, d1.State)
+	assert.Equal(t, "machine1", d1.Name, "finds a free machine1")
+
+	d2, err := p.useMachine(machineDefaultConfig, time.Time{})
+	assert.NotNil(t, d2)
+	assert.NoError(t, err)
+	assert.Equal(t, machineStateAcquired, d2.State)
+	assert.NotEqual(t, "machine1", d2.Name, "creates a new machine")
+
+	_, err = p.useMachine(machineProvisionFail, time.Time{})
+	assert.Error(t, err, "fails to create a new machine")
+}
+
+func TestMachineCreateFailurePropagatesDetails(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(0, 1)
+	config.Machine.MachineName = "detailed-fail-%s"
+
+	d, errCh := p.create(config, machineStateAcquired)
+	err := <-errCh
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "E_FAIL", "the driver output reaches the caller")
+	assert.Contains(t, d.Reason, "E_FAIL", "the removal reason carries the detailed error")
+}
+
+func TestMachineBudgetGuardrail(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, _ := testMachineProvider()
+
+	used := p.machineDetails("expensive-machine", false)
+	used.State = machineStateUsed
+	used.Created = time.Now().Add(-100 * time.Hour)
+
+	config := createMachineConfig(0, 1)
+	config.Machine.HourlyCost = 1
+	config.Machine.MonthlyBudget = 50
+
+	_, err := p.useMachine(config, time.Time{})
+	assert.Error(t, err, "creation is refused once the projected cost exceeds the budget")
+	assert.Contains(t, err.Error(), "budget")
+
+	config.Machine.MonthlyBudget = 500
+	d, err := p.useMachine(config, time.Time{})
+	assert.NoError(t, err, "creation is allowed while within the budget")
+	assert.NotNil(t, d)
+}
+
+func TestMachineTestRetry(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, _ := testMachineProvider()
+	_, err := p.useMachine(machineSecondFail, time.Time{})
+	assert.Error(t, err, "fails to create a new machine")
+
+	p, _ = testMachineProvider()
+	d1, err := p.retryUseMachine(machineSecondFail)
+	assert.NoError(t, err, "after replying the same test scenario and using retry it succeeds")
+	assert.Equal(t, machineStateAcquired, d1.State)
+}
+
+func TestMachineAcquireAndRelease(t *testing.T) {
+	p, _ := testMachineProvider("test-machine")
+
+	d1, err := p.Acquire(machineDefaultConfig)
+	assert.NoError(t, err)
+	assert.NotNil(t, d1, "acquires machine")
+
+	d2, _ := p.Acquire(machineDefaultConfig)
+	assert.Nil(t, d2, "fails to acquire a machine")
+
+	p.Release(machineDefaultConfig, d1)
+
+	d3, err := p.Acquire(machineDefaultConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, d1, d3, "acquires released machine")
+}
+
+func TestMachineStoragePath(t *testing.T) {
+	p, tm := testMachineProvider("test-machine")
+
+	config := createMachineConfig(0, 1)
+	config.Machine.StoragePath = "/tmp/runner-machines"
+
+	_, err := p.Acquire(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp/runner-machines", tm.StoragePath, "the configured path is forwarded to the machine backend")
+}
+
+func TestMachineReleaseAndRemove(t *testing.T) {
+	p, _ := testMachineProvider("test-machine", "test-machine2")
+
+	d1, err := p.Acquire(machineDefaultConfig)
+	assert.NoError(t, err)
+
+	p.Release(machineDefaultConfig, d1)
+	dd1 := d1.(*machineDetails)
+	assert.Equal(t, machineStateIdle, dd1.State, "a normal release re-idles the machine")
+
+	d2, err := p.Acquire(machineDefaultConfig)
+	assert.NoError(t, err)
+
+	p.ReleaseAndRemove(machineDefaultConfig, d2)
+	dd2 := d2.(*machineDetails)
+	assert.Equal(t, machineStateRemoving, dd2.State, "a forced release removes the machine")
+	assert.Equal(t, "Released dirty", dd2.Reason)
+}
+
+func TestMachineOnDemandMode(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(0, 1)
+	_, err := p.Acquire(config)
+	assert.NoError(t, err)
+}
+
+func TestMachinePreCreateMode(t *testing.T) {
+	p, m := testMachineProvider()
+
+	config := createMachineConfig(1, 5)
+	d, err := p.Acquire(config)
+	assert.Error(t, err, "it should fail with message that currently there's no free machines")
+	assert.Nil(t, d)
+
+	<-m.Created
+	assertIdleMachines(t, p, 1, "it should contain exactly one machine")
+
+	d, err = p.Acquire(config)
+	assert.NoError(t, err, "it should be ready to process builds")
+	assertIdleMachines(t, p, 0, "it should acquire the free node")
+	p.Release(config, d)
+	assertIdleMachines(t, p, 1, "after releasing it should have one free node")
+
+	config = createMachineConfig(2, 5)
+	d, err = p.Acquire(config)
+	assert.NoError(t, err)
+	p.Release(config, d)
+
+	<-m.Created
+	assertIdleMachines(t, p, 2, "it should start creating a second machine")
+
+	config = createMachineConfig(1, 0)
+	config.Limit = 1
+	d, err = p.Acquire(config)
+	assert.NoError(t, err)
+	p.Release(config, d)
+
+	<-m.Stopped
+	<-m.Removed
+	assertIdleMachines(t, p, 1, "it should downscale to single machine")
+
+	d, err = p.Acquire(config)
+	assert.NoError(t, err, "we should acquire single machine")
+
+	_, err = p.Acquire(config)
+	assert.Error(t, err, "it should fail with message that currently there's no free machines")
+	p.Release(config, d)
+	assertIdleMachines(t, p, 1, "it should leave one idle")
+}
+
+func TestMachineExplicitOnDemandMode(t *testing.T) {
+	p, tm := testMachineProvider()
+
+	config := createMachineConfig(2, 5)
+	config.Machine.Mode = "on-demand"
+
+	d, err := p.Acquire(config)
+	assert.NoError(t, err, "on-demand acquires succeed and defer creation to Use")
+	assert.Nil(t, d)
+
+	select {
+	case <-tm.Created:
+		t.Fatal("explicit on-demand mode must not pre-create machines")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assertTotalMachines(t, p, 0, "the mistakenly configured IdleCount should be ignored")
+
+	details, err := p.retryUseMachine(config)
+	assert.NoError(t, err, "creating a machine for an actual job still works")
+	assert.NotNil(t, details)
+}
+
+func TestMachineConcurrentAcquireDoesNotOvershootIdleCount(t *testing.T) {
+	p, _ := testMachineProvider()
+	config := createMachineConfig(3, 5)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Acquire(config)
+		}()
+	}
+	wg.Wait()
+
+	assertTotalMachines(t, p, 3, "it should create exactly IdleCount machines")
+}
+
+func TestMachineStandbyPromotion(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(1, 5)
+	config.Machine.StandbyCount = 1
+
+	_, err := p.Acquire(config)
+	assert.Error(t, err, "it should fail with message that currently there's no free machines")
+	assertIdleMachines(t, p, 1, "it should create the idle machine")
+
+	for i := 0; i < 10 && countMachinesInState(p, machineStateStandby) != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 1, countMachinesInState(p, machineStateStandby), "it should create the standby machine")
+
+	var idleName string
+	p.machines().each(func(details *machineDetails) {
+		if details.State == machineStateIdle {
+			idleName = details.Name
+		}
+	})
+
+	assert.NoError(t, p.remove(idleName, "machine is unavailable"))
+	assertIdleMachines(t, p, 1, "a standby should be promoted to maintain the target")
+	assert.Equal(t, 0, countMachinesInState(p, machineStateStandby), "the standby sub-pool is drained by the promotion")
+}
+
+func TestMachineStopOnDownscale(t *testing.T) {
+	p, tm := testMachineProvider()
+
+	config := createMachineConfig(1, 0)
+	config.Machine.StopOnDownscale = true
+	_, err := p.Acquire(config)
+	assert.Error(t, err)
+	assertIdleMachines(t, p, 1)
+
+	// dropping the idle target to zero parks the machine instead of
+	// removing it
+	config = createMachineConfig(0, 0)
+	config.Machine.StopOnDownscale = true
+	p.Acquire(config)
+
+	<-tm.Stopped
+	assertIdleMachines(t, p, 0)
+	assertTotalMachines(t, p, 1, "a stopped machine should keep holding its slot")
+	assert.Equal(t, 1, countMachinesInState(p, machineStateStopped))
+	assert.Equal(t, 0, tm.StartCalls)
+
+	// demand returns: the sweep wakes the stopped machine instead of
+	// creating a fresh one
+	config = createMachineConfig(1, 5)
+	config.Machine.StopOnDownscale = true
+	_, err = p.Acquire(config)
+	assert.Error(t, err)
+	assertIdleMachines(t, p, 1, "the stopped machine should rejoin the pool")
+	assertTotalMachines(t, p, 1, "no fresh machine should be created while one can be restarted")
+	assert.Equal(t, 1, tm.StartCalls)
+
+	d, err := p.Acquire(config)
+	assert.NoError(t, err)
+	assert.NotNil(t, d)
+}
+
+func TestMachinePreferOwnOverAdopted(t *testing.T) {
+	p, _ := testMachineProvider("machine1", "machine2", "machine3")
+	p.machineDetails("machine2", false).Adopted = true
+	p.machineDetails("machine3", false).Adopted = true
+
+	d := p.findFreeMachine("", "", false, "machine1", "machine2", "machine3")
+	assert.NotNil(t, d)
+	assert.Equal(t, "machine1", d.Name, "the machine this process created should win over newer adopted ones")
+
+	d = p.findFreeMachine("", "", false, "machine1", "machine2", "machine3")
+	assert.NotNil(t, d)
+	assert.True(t, d.Adopted, "with no own machine free the preference must not block the adopted ones")
+}
+
+func TestMachineAcquireForJob(t *testing.T) {
+	p, _ := testMachineProvider()
+	config := createMachineConfig(1, 5)
+
+	_, err := p.Acquire(config)
+	assert.Error(t, err)
+	assertIdleMachines(t, p, 1)
+
+	d1, err := p.AcquireForJob(config, 1234)
+	assert.NoError(t, err)
+	details, ok := d1.(*machineDetails)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1234), details.BoundJob)
+
+	d2, err := p.AcquireForJob(config, 1234)
+	assert.NoError(t, err)
+	assert.True(t, d1 == d2, "a retried acquire of the same job should return the bound machine")
+
+	p.Release(config, d1)
+	assert.Empty(t, p.boundMachine(1234), "releasing should clear the binding")
+	assert.Equal(t, int64(0), details.BoundJob)
+}
+
+func TestMachineIdleTargetFunc(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	target := 3
+	p.IdleTargetFunc = func(config *common.RunnerConfig) int {
+		return target
+	}
+
+	config := createMachineConfig(0, 0)
+	_, err := p.Acquire(config)
+	assert.Error(t, err, "it should fail with message that currently there's no free machines")
+	assertIdleMachines(t, p, 3, "it should scale to the external idle target")
+
+	target = 1
+	d, err := p.Acquire(config)
+	assert.NoError(t, err)
+	p.Release(config, d)
+	assertIdleMachines(t, p, 1, "it should track the lowered idle target")
+}
+
+func TestMachineIdleCountCappedAtLimit(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	p, _ := testMachineProvider()
+	config := createMachineConfig(5, 5)
+	config.Limit = 2
+
+	assert.Equal(t, 2, p.idleCount(config))
+
+	_, err := p.Acquire(config)
+	assert.Error(t, err)
+	assertIdleMachines(t, p, 2, "the pool should cap at Limit despite the higher IdleCount")
+	assertTotalMachines(t, p, 2)
+
+	p.idleCount(config)
+	warnings := 0
+	for _, entry := range hook.AllEntries() {
+		if strings.Contains(entry.Message, "IdleCount exceeds Limit") {
+			warnings++
+		}
+	}
+	assert.Equal(t, 1, warnings, "the clamp should be warned about exactly once")
+}
+
+func TestMachineAdaptiveIdleTime(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(2, 1)
+	_, err := p.Acquire(config)
+	assert.Error(t, err)
+	assertIdleMachines(t, p, 2)
+
+	// intermittent acquires keep the utilization low, which grows the
+	// effective idle time above the configured base
+	for i := 0; i < 5; i++ {
+		d, err := p.Acquire(config)
+		assert.NoError(t, err)
+		p.Release(config, d)
+	}
+	assert.True(t, p.lowDemandSweeps > 1, "sustained low demand should be tracked")
+
+	// age the idle machines beyond the base IdleTime
+	p.machines().each(func(details *machineDetails) {
+		if details.State == machineStateIdle {
+			details.Used = time.Now().Add(-2 * time.Second)
+		}
+	})
+
+	config = createMachineConfig(0, 1)
+	_, err = p.Acquire(config)
+	assert.NoError(t, err)
+	assertTotalMachines(t, p, 2, "idle machines should survive longer than the base IdleTime under sustained low demand")
+
+	// returning demand resets the growth back to the base IdleTime
+	p.machines().each(func(details *machineDetails) {
+		details.State = machineStateUsed
+	})
+
+	for i := 0; i < 5; i++ {
+		_, _ = p.Acquire(config)
+	}
+	assert.Equal(t, 0, p.lowDemandSweeps, "high utilization should reset the idle time growth")
+}
+
+func TestMachineAcquireWaiters(t *testing.T) {
+	p, _ := testMachineProvider()
+	config := createMachineConfig(0, 1)
+
+	p.acquireLock.Lock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = p.Acquire(config)
+		}()
+	}
+
+	waiters := 0
+	for i := 0; i < 100; i++ {
+		if waiters = p.AcquireWaiters(); waiters == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 3, waiters, "all blocked acquirers should be counted")
+
+	p.acquireLock.Unlock()
+	wg.Wait()
+	assert.Equal(t, 0, p.AcquireWaiters(), "finished acquirers should no longer be counted")
+}
+
+func TestMachineLimitMax(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(10, 5)
+	config.Limit = 5
+
+	d, err := p.Acquire(config)
+	assert.Error(t, err, "it should fail with message that currently there's no free machines")
+	assert.Nil(t, d)
+	assertIdleMachines(t, p, 5, "it should contain exactly a maximum of 5 nodes")
+
+	config.Limit = 8
+	d, err = p.Acquire(config)
+	p.Release(config, d)
+	assertIdleMachines(t, p, 8, "it should upscale to 8 nodes")
+
+	config.Limit = 2
+	d, err = p.Acquire(config)
+	p.Release(config, d)
+	assertIdleMachines(t, p, 2, "it should downscale to 2 nodes")
+}
+
+func TestMachineLimitBurst(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(10, 5)
+	config.Limit = 5
+	config.LimitBurst = 3
+
+	d, err := p.Acquire(config)
+	assert.Error(t, err, "it should fail with message that currently there's no free machines")
+	assert.Nil(t, d)
+	assertIdleMachines(t, p, 8, "it should burst up to Limit+LimitBurst nodes")
+
+	config = createMachineConfig(2, 5)
+	config.Limit = 5
+	config.LimitBurst = 3
+	d, err = p.Acquire(config)
+	assert.NoError(t, err)
+	p.Release(config, d)
+	assertIdleMachines(t, p, 5, "it should remove the burst machines first on scale-down")
+
+	p.machines().each(func(details *machineDetails) {
+		if details.State == machineStateIdle {
+			assert.False(t, details.Burst, "steady-state machines should outlive the burst ones")
+		}
+	})
+}
+
+func countIdleMachinesWithShape(p *machineProvider, shape string) (count int) {
+	p.machines().each(func(details *machineDetails) {
+		if details.Shape == shape && details.State == machineStateIdle {
+			count++
+		}
+	})
+	return
+}
+
+func TestMachinePerFlavorIdle(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(1, 5)
+	config.Machine.MachineFlavors = []*common.DockerMachineFlavor{
+		{Name: "gpu", IdleCount: 0, IdleTime: 0},
+		{Name: "highcpu", IdleCount: 2, IdleTime: 5},
+	}
+
+	_, err := p.Acquire(config)
+	assert.Error(t, err)
+	assertIdleMachines(t, p, 3, "the main pool and each flavor should reach their own idle target")
+
+	assert.Equal(t, 1, countIdleMachinesWithShape(p, ""))
+	assert.Equal(t, 0, countIdleMachinesWithShape(p, "flavor:gpu"), "an expensive flavor can keep zero idle machines")
+	assert.Equal(t, 2, countIdleMachinesWithShape(p, "flavor:highcpu"))
+
+	config.Machine.MachineFlavors[1].IdleCount = 1
+	config.Machine.MachineFlavors[1].IdleTime = 0
+
+	d, err := p.Acquire(config)
+	assert.NoError(t, err)
+	p.Release(config, d)
+	assertIdleMachines(t, p, 2, "the flavor should scale down to the lowered target")
+	assert.Equal(t, 1, countIdleMachinesWithShape(p, ""), "the main pool should be unaffected by the flavor scale-down")
+	assert.Equal(t, 1, countIdleMachinesWithShape(p, "flavor:highcpu"))
+}
+
+func TestMachineWeightedLimit(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(0, 5)
+	small := &common.DockerMachineFlavor{Name: "small", Weight: 1}
+	big := &common.DockerMachineFlavor{Name: "big", Weight: 2}
+	config.Machine.MachineFlavors = []*common.DockerMachineFlavor{small, big}
+	config.Machine.MaxWeight = 5
+
+	// Two small (weight 2) plus one big (weight 2) fit under the cap
+	for i := 0; i < 2; i++ {
+		_, errCh := p.create(flavorConfig(config, small), machineStateIdle)
+		assert.NoError(t, <-errCh)
+	}
+	_, errCh := p.create(flavorConfig(config, big), machineStateIdle)
+	assert.NoError(t, <-errCh)
+
+	// Another big machine would push the total weight to 6
+	_, errCh = p.create(flavorConfig(config, big), machineStateIdle)
+	assert.Error(t, <-errCh, "a big machine should be refused once its weight exceeds the cap")
+
+	// A small one still fits into the remaining weight
+	_, errCh = p.create(flavorConfig(config, small), machineStateIdle)
+	assert.NoError(t, <-errCh)
+	assertTotalMachines(t, p, 4, "the weight cap should track flavor sizes, not the machine count")
+}
+
+func TestMachinePerFlavorLimit(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(0, 5)
+	gpu := &common.DockerMachineFlavor{Name: "gpu", Limit: 2}
+	config.Machine.MachineFlavors = []*common.DockerMachineFlavor{gpu}
+	config.Machine.MaxTotalMachines = 50
+
+	// The flavor hands out machines up to its own cap
+	for i := 0; i < 2; i++ {
+		d, err := p.useMachine(flavorConfig(config, gpu), time.Time{})
+		assert.NoError(t, err)
+		assert.NotNil(t, d)
+	}
+
+	// The next one is refused even though the global limit is far away
+	_, err := p.useMachine(flavorConfig(config, gpu), time.Time{})
+	assert.Error(t, err, "the flavor limit should refuse the third GPU machine")
+	if err != nil {
+		assert.Contains(t, err.Error(), `flavor "gpu"`)
+	}
+
+	// The shared pool is unaffected by the exhausted flavor
+	_, errCh := p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+	assertTotalMachines(t, p, 3, "the flavor cap must not eat into the shared pool")
+}
+
+func TestMachineFlavorFallback(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(0, 5)
+	spot := &common.DockerMachineFlavor{Name: "spot", Limit: 1, FlavorFallback: []string{"ondemand"}}
+	ondemand := &common.DockerMachineFlavor{Name: "ondemand"}
+	config.Machine.MachineFlavors = []*common.DockerMachineFlavor{spot, ondemand}
+
+	d, err := p.useMachine(flavorConfig(config, spot), time.Time{})
+	assert.NoError(t, err)
+	if assert.NotNil(t, d) {
+		assert.Equal(t, "flavor:spot", d.Shape)
+	}
+
+	// The spot flavor is exhausted: the chain hands out an on-demand
+	// machine instead of failing the job
+	d, err = p.useMachine(flavorConfig(config, spot), time.Time{})
+	assert.NoError(t, err, "the fallback flavor should cover for the exhausted one")
+	if assert.NotNil(t, d) {
+		assert.Equal(t, "flavor:ondemand", d.Shape)
+	}
+	assertTotalMachines(t, p, 2)
+}
+
+func TestMachineReady(t *testing.T) {
+	p, _ := testMachineProvider()
+
+	config := createMachineConfig(2, 5)
+	config.Machine.MinIdleCount = 2
+	p.setMinIdleTarget(config.Machine.MinIdleCount)
+
+	ready, reason := p.Ready()
+	assert.False(t, ready, "the provider should report not-ready before the warm pool exists")
+	assert.Contains(t, reason, "warm pool not ready")
+
+	p.Acquire(config)
+	assertIdleMachines(t, p, 2)
+
+	ready, reason = p.Ready()
+	assert.True(t, ready, "reaching the MinIdleCount should flip the probe to ready")
+	assert.Empty(t, reason)
+
+	p.Close()
+	ready, reason = p.Ready()
+	assert.False(t, ready)
+	assert.Equal(t, "provider is closed", reason)
+}
+
+func TestMachineDrain(t *testing.T) {
+	drainCheckInterval = time.Millisecond
+
+	p, _ := testMachineProvider()
+	config := createMachineConfig(2, 5)
+	_, err := p.Acquire(config)
+	assert.Error(t, err)
+	assertIdleMachines(t, p, 2)
+
+	finishing := p.machineDetails("finishing-machine", false)
+	finishing.State = machineStateUsed
+	overstaying := p.machineDetails("overstaying-machine", false)
+	overstaying.State = machineStateUsed
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		p.Release(config, finishing)
+	}()
+
+	p.Drain(50*time.Millisecond, true)
+
+	assert.Equal(t, 0, countIdleMachines(p), "free machines should be cordoned for removal")
+	assert.Equal(t, machineStateRemoving, finishing.State, "a machine released before the deadline should drain cleanly")
+	assert.Equal(t, "Draining pool", finishing.Reason)
+	assert.Equal(t, machineStateRemoving, overstaying.State, "machines busy past the deadline should be force-removed")
+	assert.Equal(t, "Drain deadline exceeded", overstaying.Reason)
+
+	_, err = p.Acquire(config)
+	assert.Error(t, err, "a draining provider should refuse new acquires")
+}
+
+func TestMachineTeardownOrderBusyFirst(t *testing.T) {
+	drainCheckInterval = time.Millisecond
+
+	p, _ := testMachineProvider("busy-machine", "idle-machine")
+	busy := p.machineDetails("busy-machine", false)
+	busy.State = machineStateUsed
+	idle := p.machineDetails("idle-machine", false)
+	p.setTeardownOrder("busy-first")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Drain(time.Hour, false)
+	}()
+
+	// As long as the build runs the idle machine must stay in place
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, machineStateIdle, idle.State, "busy-first must not cordon idle machines while builds run")
+
+	p.Release(nil, busy)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the drain did not finish after the last build was released")
+	}
+
+	assertTotalMachines(t, p, 0, "every machine should be removed once the builds are gone")
+}
+
+func TestMachineMaxBuildsForExistingMachines(t *testing.T) {
+	provisionRetryInterval = 0
+
+	p, _ := testMachineProvider("remove-fail")
+	config := createMachineConfig(1, 5)
+	config.Machine.MaxBuilds = 1
+	d, err := p.Acquire(config)
+	assert.Error(t, err)
+	assert.Nil(t, d)
+}
+
+func TestMachineMaxBuilds(t *testing.T) {
+	config := createMachineConfig(1, 5)
+	p, _ := testMachineProvider(newMachineName(config))
+	config.Machine.MaxBuilds = 2 // by default we set it to 1
+	d, err := p.Acquire(config)
+	assert.NoError(t, err)
+	assert.NotNil(t, d)
+
+	_, nd, err := p.Use(config, d)
+	assert.NoError(t, err)
+	assert.Nil(t, nd, "we passed the data, we should not get the data now")
+
+	p.Release(config, d)
+
+	dd := d.(*machineDetails)
+	assert.Equal(t, machineStateRemoving, dd.State, "the machine should be removed due to too many builds")
+	assert.Equal(t, "Too many builds", dd.Reason, "the machine should be removed due to too many builds")
+}
+
+func TestMachineCountBuildsAtStart(t *testing.T) {
+	config := createMachineConfig(1, 5)
+	p, _ := testMachineProvider(newMachineName(config))
+	config.Machine.MaxBuilds = 2 // seeded machines start at UsedCount 1
+	config.Machine.CountBuildsAt = "start"
+
+	d, err := p.Acquire(config)
+	assert.NoError(t, err)
+	assert.NotNil(t, d)
+
+	_, _, err = p.Use(config, d)
+	assert.NoError(t, err)
+	dd := d.(*machineDetails)
+	assert.Equal(t, 2, dd.UsedCount, "the build should count the moment the machine is handed out")
+
+	p.Release(config, d)
+	assert.Equal(t, machineStateRemoving, dd.State)
+	assert.Equal(t, "Too many builds", dd.Reason)
+}
+
+func TestMachineCountBuildsAtFinish(t *testing.T) {
+	config := createMachineConfig(1, 5)
+	p, _ := testMachineProvider(newMachineName(config))
+	config.Machine.MaxBuilds = 2 // seeded machines start at UsedCount 1
+	config.Machine.CountBuildsAt = "finish"
+
+	d, err := p.Acquire(config)
+	assert.NoError(t, err)
+	assert.NotNil(t, d)
+
+	_, _, err = p.Use(config, d)
+	assert.NoError(t, err)
+	dd := d.(*machineDetails)
+	assert.Equal(t, 1, dd.UsedCount, "the running build must not count before it finishes")
+
+	p.Release(config, d)
+	assert.Equal(t, 2, dd.UsedCount, "the finished build should count on release")
+	assert.Equal(t, machineStateRemoving, dd.State, "the machine should rotate once its finished builds reach MaxBuilds")
+	assert.Equal(t, "Too many builds", dd.Reason)
+}
+
+func TestMachineUseReleasesForeignMachine(t *testing.T) {
+	p, _ := testMachineProvider("machine1", "machine2")
+	config := createMachineConfig(1, 5)
+
+	foreign := p.findFreeMachine("", "", false, "machine1")
+	assert.NotNil(t, foreign)
+	// Pretend the machine was created under another configuration
+	foreign.Shape = "instance-type=big"
+
+	_, nd, err := p.Use(config, foreign)
+	assert.NoError(t, err)
+	assert.NotNil(t, nd, "an incompatible machine should be replaced by a compatible one")
+	assert.NotEqual(t, foreign, nd)
+	assert.Equal(t, machineStateIdle, foreign.State,
+		"the incompatible machine should go back to its own pool")
+}
+
+func TestMachineDriverAndNodeCapture(t *testing.T) {
+	p, _ := testMachineProvider()
+	config := createMachineConfig(0, 1)
+	config.Machine.MachineDriver = "virtualbox"
+
+	details, errCh := p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, "virtualbox", details.Driver, "created machines should record the configured driver")
+	assert.Equal(t, "tcp://"+details.Name+":2376", details.Node,
+		"created machines should record the endpoint they answer on")
+
+	// Adopted machines ask the backend instead
+	p2, _ := testMachineProvider("orphan")
+	assert.NoError(t, p2.Reconcile())
+	adopted := p2.machines().get("orphan")
+	if assert.NotNil(t, adopted) {
+		assert.Equal(t, "test", adopted.Driver)
+		assert.Equal(t, "tcp://orphan:2376", adopted.Node)
+	}
+}
+
+func TestMachineRemoveAfterFailedBuilds(t *testing.T) {
+	p, _ := testMachineProvider("machine1")
+	config := createMachineConfig(1, 5)
+	config.Machine.MaxBuildFailures = 2
+
+	d := p.findFreeMachine("", "", false, "machine1")
+	assert.NotNil(t, d)
+	_, _, err := p.Use(config, d)
+	assert.NoError(t, err)
+	p.ReportBuildResult(d, false)
+	p.Release(config, d)
+	assert.Equal(t, machineStateIdle, d.State, "one failure is below the streak limit")
+
+	d = p.findFreeMachine("", "", false, "machine1")
+	assert.NotNil(t, d)
+	_, _, err = p.Use(config, d)
+	assert.NoError(t, err)
+	p.ReportBuildResult(d, false)
+	p.Release(config, d)
+	assert.Equal(t, machineStateRemoving, d.State, "the streak limit should remove the machine")
+	assert.Equal(t, "Too many consecutive build failures", d.Reason)
+}
+
+func TestMachineBuildFailureStreakReset(t *testing.T) {
+	p, _ := testMachineProvider("machine1")
+	config := createMachineConfig(1, 5)
+	config.Machine.MaxBuildFailures = 2
+
+	results := []bool{false, true, false}
+	for _, success := range results {
+		d := p.findFreeMachine("", "", false, "machine1")
+		assert.NotNil(t, d)
+		_, _, err := p.Use(config, d)
+		assert.NoError(t, err)
+		p.ReportBuildResult(d, success)
+		p.Release(config, d)
+		assert.Equal(t, machineStateIdle, d.State, "a success mid-streak should keep the machine alive")
+	}
+}
+
+func TestMachineLastError(t *testing.T) {
+	p, _ := testMachineProvider("machine1")
+	details := p.machineDetails("machine1", false)
+
+	err := p.guardDriverCall("machine1", func() error {
+		return errors.New("first failure")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "first failure", details.LastError)
+	assert.False(t, details.LastErrorAt.IsZero())
+
+	err = p.guardDriverCall("machine1", func() error {
+		return errors.New("second failure")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "second failure", details.LastError, "the most recent error should win")
+
+	at := details.LastErrorAt
+	err = p.guardDriverCall("machine1", func() error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "second failure", details.LastError, "a successful call should not clear the record")
+	assert.Equal(t, at, details.LastErrorAt)
+}
+
+func TestMachineMaxUseTime(t *testing.T) {
+	config := createMachineConfig(1, 5)
+	config.Machine.MaxMachineUseTime = 1
+
+	name := newMachineName(config)
+	p, _ := testMachineProvider(name)
+
+	details := p.machineDetails(name, false)
+	details.State = machineStateUsed
+	details.Used = time.Now().Add(-2 * time.Second)
+
+	p.Release(config, details)
+	assert.True(t, details.UsedTime >= 2*time.Second, "the time spent in the Used state should accumulate")
+	assert.Equal(t, machineStateRemoving, details.State, "the machine should be removed due to too long use")
+	assert.Equal(t, "Too long in use", details.Reason)
 }
 
 func TestMachineIdleLimits(t *testing.T) {
@@ -556,6 +2604,24 @@ func TestMachineUseOnDemand(t *testing.T) {
 	assertTotalMachines(t, p, 3, "it fails on no-connect, but we leave the machine created")
 }
 
+func TestMachineUseConnectRetry(t *testing.T) {
+	connectRetryInterval = 0
+
+	p, tm := testMachineProvider("flaky-connect-machine")
+	tm.flakyConnects = 2
+
+	config := createMachineConfig(0, 5)
+	config.Machine.MachineName = "flaky-connect-%s"
+	config.Machine.ConnectRetries = 3
+
+	dd := p.machineDetails("flaky-connect-machine", true)
+	_, nd, err := p.Use(config, dd)
+	assert.NoError(t, err, "the machine connects after retries")
+	assert.Nil(t, nd, "the passed machine is kept")
+	assert.Equal(t, machineStateUsed, dd.State, "the machine stays in use")
+	assert.True(t, tm.ConnectCalls >= 3, "it should have retried the connectivity probe")
+}
+
 func TestMachineReleaseIfInvalidDataArePassed(t *testing.T) {
 	p, _ := testMachineProvider()
 
@@ -0,0 +1,64 @@
+package machine
+
+import (
+	"context"
+	"sync"
+)
+
+// waiterTickets orders the AcquireContext waiters by arrival, so that
+// each of them can be told its place in the queue
+type waiterTickets struct {
+	lock    sync.Mutex
+	nextSeq uint64
+	active  map[uint64]struct{}
+}
+
+// enter hands out the next ticket and marks it as waiting
+func (q *waiterTickets) enter() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.active == nil {
+		q.active = make(map[uint64]struct{})
+	}
+	q.nextSeq++
+	q.active[q.nextSeq] = struct{}{}
+	return q.nextSeq
+}
+
+func (q *waiterTickets) leave(ticket uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.active, ticket)
+}
+
+// position returns the 1-based place of the ticket among the waiters
+// still in the queue; it shrinks as earlier arrivals are served
+func (q *waiterTickets) position(ticket uint64) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	position := 1
+	for other := range q.active {
+		if other < ticket {
+			position++
+		}
+	}
+	return position
+}
+
+type queueProgressKey struct{}
+
+// WithQueueProgress returns a context that makes AcquireContext report
+// the waiter's queue position on ch, so the executor can tell the job
+// log how far from the front it is. Every change of position is sent at
+// most once; sends never block, a slow consumer just misses updates
+func WithQueueProgress(ctx context.Context, ch chan<- int) context.Context {
+	return context.WithValue(ctx, queueProgressKey{}, ch)
+}
+
+func queueProgress(ctx context.Context) chan<- int {
+	ch, _ := ctx.Value(queueProgressKey{}).(chan<- int)
+	return ch
+}
@@ -0,0 +1,40 @@
+package machine
+
+import "sort"
+
+// removalComparator reports whether machine a should be removed before
+// machine b when the pool scales down
+type removalComparator func(a, b *machineDetails) bool
+
+// removalComparatorFor maps the configured removal strategy to its
+// comparator; an empty strategy returns nil and the sweep keeps the
+// backend list order
+func removalComparatorFor(strategy string) removalComparator {
+	switch strategy {
+	case "oldest-first":
+		return func(a, b *machineDetails) bool {
+			return a.Created.Before(b.Created)
+		}
+	case "youngest-first":
+		return func(a, b *machineDetails) bool {
+			return a.Created.After(b.Created)
+		}
+	case "most-used-first":
+		return func(a, b *machineDetails) bool {
+			return a.UsedCount > b.UsedCount
+		}
+	}
+	return nil
+}
+
+// orderForRemoval sorts names so that the machines the strategy prefers
+// to remove are swept last: the machines evaluated first consume the
+// idle quota and whatever overflows it gets removed
+func (m *machineProvider) orderForRemoval(names []string, prefer removalComparator) {
+	if prefer == nil {
+		return
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return prefer(m.machineDetails(names[j], false), m.machineDetails(names[i], false))
+	})
+}
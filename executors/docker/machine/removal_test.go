@@ -0,0 +1,42 @@
+package machine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachineRemovalStrategies(t *testing.T) {
+	tests := map[string]string{
+		"oldest-first":    "machine1",
+		"youngest-first":  "machine3",
+		"most-used-first": "machine2",
+	}
+
+	for strategy, removed := range tests {
+		t.Run(strategy, func(t *testing.T) {
+			p, _ := testMachineProvider("machine1", "machine2", "machine3")
+			config := createMachineConfig(2, 0)
+			config.Machine.RemovalStrategy = strategy
+
+			ages := map[string]time.Duration{
+				"machine1": 3 * time.Hour,
+				"machine2": 2 * time.Hour,
+				"machine3": time.Hour,
+			}
+			for name, age := range ages {
+				details := p.machineDetails(name, false)
+				details.Created = time.Now().Add(-age)
+				details.Used = time.Now().Add(-time.Hour)
+			}
+			p.machineDetails("machine2", false).UsedCount = 9
+
+			_, validMachines := p.updateMachines([]string{"machine1", "machine2", "machine3"}, config)
+			assert.Len(t, validMachines, 2)
+			assert.NotContains(t, validMachines, removed)
+			assert.Equal(t, machineStateRemoving, p.machineDetails(removed, false).State,
+				"the strategy should pick which machine leaves the pool")
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package machine
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+)
+
+// nextScalingInterval returns the delay before the next scaling tick:
+// the configured base interval plus a random jitter, so that many
+// runners on one host don't hit the cloud API in synchronized bursts.
+// Without an explicit jitter a tenth of the base interval is used
+func nextScalingInterval(config *common.RunnerConfig) time.Duration {
+	base := time.Duration(config.Machine.ScalingInterval) * time.Second
+	if base <= 0 {
+		base = defaultScalingInterval
+	}
+
+	jitter := time.Duration(config.Machine.ScalingJitter) * time.Second
+	if jitter <= 0 {
+		jitter = base / 10
+	}
+	if jitter > 0 {
+		base += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return base
+}
+
+// ScaleTo forces the pool to the given number of idle machines right
+// away, bypassing the ramp heuristics of the regular scaling sweep:
+// operators call it ahead of a planned load spike instead of waiting for
+// the pool to grow on its own. Limit and MaxTotalMachines still apply —
+// the caps clamp the target, never the other way around. Surplus idle
+// machines are removed immediately when the target is below the current
+// pool size
+func (m *machineProvider) ScaleTo(config *common.RunnerConfig, target int) error {
+	if target < 0 {
+		return errors.New("scale target must not be negative")
+	}
+
+	machines, err := m.loadMachines(config)
+	if err != nil {
+		return err
+	}
+	data, _ := m.updateMachines(machines, config)
+
+	for data.Available() < target {
+		if config.Limit > 0 && data.Total() >= config.Limit {
+			break
+		}
+		details, _ := m.create(config, machineStateIdle)
+		if details == nil {
+			break
+		}
+		data.Creating++
+	}
+
+	// Scale down by retiring surplus idle machines of this config only:
+	// the provider is shared between runner configs, so the sweep must
+	// not touch another runner's machines. Reserved and flavored machines
+	// keep following their own rules
+	filter := machineFilter(config)
+	var surplus []string
+	m.machines().each(func(details *machineDetails) {
+		if details.State != machineStateIdle || details.Reserved {
+			return
+		}
+		if !matchesMachineFilter(details.Name, filter) {
+			return
+		}
+		if findFlavor(config, details.Shape) != nil {
+			return
+		}
+		surplus = append(surplus, details.Name)
+	})
+
+	excess := data.Idle - target
+	for _, name := range surplus {
+		if excess <= 0 {
+			break
+		}
+		if m.remove(name, "Scaled down by operator") == nil {
+			excess--
+		}
+	}
+	return nil
+}
+
+// RunScalingLoop runs the scaling sweep on a jittered tick until the
+// provider is closed, keeping the pool at its targets even when no
+// Acquire calls come in
+func (m *machineProvider) RunScalingLoop(config *common.RunnerConfig) {
+	for {
+		select {
+		case <-m.done():
+			return
+		case <-time.After(nextScalingInterval(config)):
+		}
+
+		machines, err := m.loadMachines(config)
+		if err != nil {
+			continue
+		}
+		data, _ := m.updateMachines(machines, config)
+		m.createMachines(config, &data)
+	}
+}
@@ -0,0 +1,95 @@
+package machine
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+)
+
+// machineOptionVariable returns the job variable name that may override
+// the given machine creation option, e.g. "amazonec2-instance-type"
+// becomes MACHINE_OPTION_AMAZONEC2_INSTANCE_TYPE
+func machineOptionVariable(option string) string {
+	return "MACHINE_OPTION_" + strings.ToUpper(strings.Replace(option, "-", "_", -1))
+}
+
+// applyMachineShape returns a copy of config with the allowlisted machine
+// option overrides from the job variables applied. The overrides form a
+// distinct machine shape, so that machines created for them are not
+// reused by jobs expecting the default shape. Without overrides the
+// original config is returned untouched
+func applyMachineShape(config *common.RunnerConfig, variables common.JobVariables) *common.RunnerConfig {
+	if config.Machine == nil || len(config.Machine.OverridableOptions) == 0 {
+		return config
+	}
+
+	overrides := make(map[string]string)
+	for _, option := range config.Machine.OverridableOptions {
+		if value := variables.Get(machineOptionVariable(option)); value != "" {
+			overrides[option] = value
+		}
+	}
+	if len(overrides) == 0 {
+		return config
+	}
+
+	newConfig := *config
+	machine := *config.Machine
+	newConfig.Machine = &machine
+
+	options := make([]string, 0, len(machine.MachineOptions)+len(overrides))
+	for _, option := range machine.MachineOptions {
+		if _, ok := overrides[strings.SplitN(option, "=", 2)[0]]; ok {
+			continue
+		}
+		options = append(options, option)
+	}
+
+	shape := make([]string, 0, len(overrides))
+	for option, value := range overrides {
+		options = append(options, option+"="+value)
+		shape = append(shape, option+"="+value)
+	}
+	sort.Strings(shape)
+
+	machine.MachineOptions = options
+	machine.MachineShape = strings.Join(shape, ",")
+	return &newConfig
+}
+
+// machineShape returns the shape requested by the given config; an empty
+// shape is the default one
+func machineShape(config *common.RunnerConfig) string {
+	if config == nil || config.Machine == nil {
+		return ""
+	}
+	return config.Machine.MachineShape
+}
+
+// applyProjectAffinity returns a copy of config carrying the project key
+// of the given build, so that machine selection can prefer the machine
+// that last ran the same project. Without ProjectAffinity enabled the
+// original config is returned untouched
+func applyProjectAffinity(config *common.RunnerConfig, build *common.Build) *common.RunnerConfig {
+	if config.Machine == nil || !config.Machine.ProjectAffinity || build == nil {
+		return config
+	}
+
+	newConfig := *config
+	machine := *config.Machine
+	newConfig.Machine = &machine
+
+	machine.AffinityKey = strconv.Itoa(build.JobInfo.ProjectID)
+	return &newConfig
+}
+
+// affinityKey returns the project key the given config would like its
+// machine to be affine to; an empty key disables the preference
+func affinityKey(config *common.RunnerConfig) string {
+	if config == nil || config.Machine == nil {
+		return ""
+	}
+	return config.Machine.AffinityKey
+}
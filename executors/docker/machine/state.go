@@ -8,6 +8,9 @@ const (
 	machineStateCreating
 	machineStateUsed
 	machineStateRemoving
+	machineStateStandby
+	machineStateQuarantine
+	machineStateStopped
 )
 
 func (t machineState) String() string {
@@ -22,6 +25,12 @@ func (t machineState) String() string {
 		return "Used"
 	case machineStateRemoving:
 		return "Removing"
+	case machineStateStandby:
+		return "Standby"
+	case machineStateQuarantine:
+		return "Quarantine"
+	case machineStateStopped:
+		return "Stopped"
 	default:
 		return "Unknown"
 	}
@@ -0,0 +1,79 @@
+package machine
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	docker_helpers "gitlab.com/gitlab-org/gitlab-runner/helpers/docker"
+)
+
+// certRegenerator is implemented by Machine backends that can rebuild a
+// machine's TLS certificates in place (docker-machine regenerate-certs)
+type certRegenerator interface {
+	Regenerate(name string) error
+}
+
+// checkCertFreshness parses the client certificate behind the given
+// credentials and reports it stale when it expires within margin.
+// Credentials without TLS material pass, and so do unreadable or garbled
+// ones: a truly broken cert fails at connect time with a clearer error
+func checkCertFreshness(dc docker_helpers.DockerCredentials, margin time.Duration) error {
+	if !dc.TLSVerify || dc.CertPath == "" {
+		return nil
+	}
+
+	pemData, err := ioutil.ReadFile(filepath.Join(dc.CertPath, "cert.pem"))
+	if err != nil {
+		return nil
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+
+	if time.Now().Add(margin).After(cert.NotAfter) {
+		return fmt.Errorf("client certificate expires %s", cert.NotAfter)
+	}
+	return nil
+}
+
+// ensureCertFreshness verifies that the machine's client certificate is
+// not expired or about to expire. A stale cert is regenerated in place
+// when the backend supports it; otherwise the machine is removed, as
+// handing out its credentials would only fail later at connect time
+func (m *machineProvider) ensureCertFreshness(details *machineDetails, dc docker_helpers.DockerCredentials) error {
+	err := checkCertFreshness(dc, certFreshnessMargin)
+	if err == nil {
+		return nil
+	}
+
+	if regenerator, ok := m.machine.(certRegenerator); ok {
+		regenErr := m.guardDriverCall(details.Name, func() error {
+			return regenerator.Regenerate(details.Name)
+		})
+		if regenErr == nil {
+			// The rebuilt certs obsolete any connection dialed with the
+			// old ones
+			if details.clients != nil {
+				details.clients.invalidate()
+			}
+			details.logger().
+				WithError(err).
+				Infoln("Regenerated stale TLS certificates")
+			return nil
+		}
+		err = regenErr
+	}
+
+	m.recordMachineError(details.Name, err)
+	m.remove(details.Name, "Stale TLS certificates")
+	return err
+}
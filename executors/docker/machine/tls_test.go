@@ -0,0 +1,95 @@
+package machine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	docker_helpers "gitlab.com/gitlab-org/gitlab-runner/helpers/docker"
+)
+
+// writeTestClientCert creates a cert directory holding a self-signed
+// client certificate with the given expiry and returns its path
+func writeTestClientCert(t *testing.T, notAfter time.Time) string {
+	dir, err := ioutil.TempDir("", "machine-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestMachineCertFreshness(t *testing.T) {
+	freshDir := writeTestClientCert(t, time.Now().Add(365*24*time.Hour))
+	defer os.RemoveAll(freshDir)
+	staleDir := writeTestClientCert(t, time.Now().Add(-time.Hour))
+	defer os.RemoveAll(staleDir)
+
+	fresh := docker_helpers.DockerCredentials{Host: "tcp://machine1:2376", CertPath: freshDir, TLSVerify: true}
+	assert.NoError(t, checkCertFreshness(fresh, certFreshnessMargin))
+
+	stale := fresh
+	stale.CertPath = staleDir
+	assert.Error(t, checkCertFreshness(stale, certFreshnessMargin), "an expired cert should be reported stale")
+
+	// Credentials without TLS material always pass
+	plain := docker_helpers.DockerCredentials{Host: "tcp://machine1:2376"}
+	assert.NoError(t, checkCertFreshness(plain, certFreshnessMargin))
+}
+
+func TestMachineStaleCertRegenerated(t *testing.T) {
+	staleDir := writeTestClientCert(t, time.Now().Add(-time.Hour))
+	defer os.RemoveAll(staleDir)
+	dc := docker_helpers.DockerCredentials{Host: "tcp://machine1:2376", CertPath: staleDir, TLSVerify: true}
+
+	p, tm := testMachineProvider("machine1")
+	details := p.machineDetails("machine1", false)
+
+	assert.NoError(t, p.ensureCertFreshness(details, dc))
+	assert.Contains(t, tm.regenerated, "machine1", "a backend that can rebuild certs should be asked to")
+	assertTotalMachines(t, p, 1, "a regenerated machine stays in the pool")
+}
+
+func TestMachineStaleCertRemoval(t *testing.T) {
+	staleDir := writeTestClientCert(t, time.Now().Add(-time.Hour))
+	defer os.RemoveAll(staleDir)
+	dc := docker_helpers.DockerCredentials{Host: "tcp://regen-fail:2376", CertPath: staleDir, TLSVerify: true}
+
+	p, tm := testMachineProvider("regen-fail")
+	details := p.machineDetails("regen-fail", false)
+
+	assert.Error(t, p.ensureCertFreshness(details, dc))
+	assert.Empty(t, tm.regenerated)
+	assertTotalMachines(t, p, 0, "a machine whose certs cannot be refreshed is removed")
+	assert.Equal(t, "Stale TLS certificates", details.Reason)
+}
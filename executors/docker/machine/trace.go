@@ -0,0 +1,86 @@
+package machine
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+)
+
+// scalingDecision records one scaling sweep: the pool counts and targets
+// it ran with and what it did about them, so that "why did it create or
+// remove right then" can be answered after the fact
+type scalingDecision struct {
+	Time       time.Time      `json:"time"`
+	Runner     string         `json:"runner"`
+	Idle       int            `json:"idle"`
+	Used       int            `json:"used"`
+	Creating   int            `json:"creating"`
+	IdleTarget int            `json:"idle_target"`
+	Limit      int            `json:"limit"`
+	Created    int            `json:"created"`
+	Removed    map[string]int `json:"removed,omitempty"`
+}
+
+// decisionTrace is a bounded ring buffer of the most recent scaling
+// decisions
+type decisionTrace struct {
+	lock    sync.Mutex
+	size    int
+	entries []scalingDecision
+}
+
+func newDecisionTrace(size int) *decisionTrace {
+	if size <= 0 {
+		size = decisionTraceSize
+	}
+	return &decisionTrace{size: size}
+}
+
+func (t *decisionTrace) Add(decision scalingDecision) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.entries = append(t.entries, decision)
+	if len(t.entries) > t.size {
+		t.entries = t.entries[len(t.entries)-t.size:]
+	}
+}
+
+func (t *decisionTrace) Entries() []scalingDecision {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entries := make([]scalingDecision, len(t.entries))
+	copy(entries, t.entries)
+	return entries
+}
+
+// recordScalingDecision files one sweep in the trace; the removal
+// reasons were counted by updateMachines while it swept the pool
+func (m *machineProvider) recordScalingDecision(config *common.RunnerConfig, data *machinesData, created int) {
+	if m.decisionTrace == nil {
+		return
+	}
+
+	m.decisionTrace.Add(scalingDecision{
+		Time:       time.Now(),
+		Runner:     config.ShortDescription(),
+		Idle:       data.Idle,
+		Used:       data.Used,
+		Creating:   data.Creating,
+		IdleTarget: m.idleCount(config),
+		Limit:      config.Limit,
+		Created:    created,
+		Removed:    data.removed,
+	})
+}
+
+// ScalingTrace returns a copy of the recent scaling decision records,
+// newest last
+func (m *machineProvider) ScalingTrace() []scalingDecision {
+	if m.decisionTrace == nil {
+		return nil
+	}
+	return m.decisionTrace.Entries()
+}
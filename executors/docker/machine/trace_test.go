@@ -0,0 +1,36 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMachineScalingDecisionTrace(t *testing.T) {
+	p, _ := testMachineProvider()
+	p.decisionTrace = newDecisionTrace(10)
+
+	config := createMachineConfig(2, 5)
+	_, err := p.Acquire(config)
+	assert.Error(t, err)
+	assertIdleMachines(t, p, 2)
+
+	entries := p.ScalingTrace()
+	require.NotEmpty(t, entries)
+	decision := entries[len(entries)-1]
+	assert.Equal(t, 2, decision.IdleTarget)
+	assert.Equal(t, 2, decision.Created)
+	assert.Equal(t, 0, decision.Idle, "the sweep started with an empty pool")
+	assert.Empty(t, decision.Removed)
+
+	// A sweep with the idle target at zero drains the pool and must
+	// record why each machine left
+	config = createMachineConfig(0, 0)
+	p.Acquire(config)
+
+	entries = p.ScalingTrace()
+	decision = entries[len(entries)-1]
+	assert.Equal(t, 0, decision.Created)
+	assert.Equal(t, 2, decision.Removed["Too many idle machines"])
+}
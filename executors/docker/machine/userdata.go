@@ -0,0 +1,68 @@
+package machine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+)
+
+// userDataFlags maps the docker-machine drivers that support startup
+// scripts to their user-data creation option
+var userDataFlags = map[string]string{
+	"amazonec2":    "--amazonec2-userdata",
+	"digitalocean": "--digitalocean-userdata",
+	"openstack":    "--openstack-user-data-file",
+	"azure":        "--azure-custom-data",
+}
+
+// userDataFile returns a file holding the given inline user-data,
+// writing it once and reusing it for as long as the content stays the
+// same
+func (m *machineProvider) userDataFile(content string) (string, error) {
+	m.userDataLock.Lock()
+	defer m.userDataLock.Unlock()
+
+	if m.userDataPath != "" && m.userDataContent == content {
+		return m.userDataPath, nil
+	}
+
+	file, err := ioutil.TempFile("", "machine-userdata")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err = file.WriteString(content); err != nil {
+		return "", err
+	}
+	m.userDataContent = content
+	m.userDataPath = file.Name()
+	return m.userDataPath, nil
+}
+
+// userDataOptions resolves the configured UserData into the driver's
+// user-data creation option. Inline content — recognized by containing
+// a newline — is written to a file first, as the drivers only take paths
+func (m *machineProvider) userDataOptions(config *common.RunnerConfig) ([]string, error) {
+	userData := config.Machine.UserData
+	if userData == "" {
+		return nil, nil
+	}
+
+	flag, ok := userDataFlags[config.Machine.MachineDriver]
+	if !ok {
+		return nil, fmt.Errorf("the %q driver does not support UserData", config.Machine.MachineDriver)
+	}
+
+	path := userData
+	if strings.Contains(userData, "\n") {
+		var err error
+		path, err = m.userDataFile(userData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []string{flag + "=" + path}, nil
+}
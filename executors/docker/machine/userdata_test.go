@@ -0,0 +1,46 @@
+package machine
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMachineUserData(t *testing.T) {
+	p, tm := testMachineProvider()
+
+	config := createMachineConfig(0, 1)
+	config.Machine.MachineDriver = "amazonec2"
+	config.Machine.UserData = "#!/bin/sh\necho hello\n"
+
+	_, errCh := p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+
+	var option string
+	for _, opt := range tm.LastCreateOpts {
+		if strings.HasPrefix(opt, "--amazonec2-userdata=") {
+			option = opt
+		}
+	}
+	require.NotEmpty(t, option, "the user-data option should be forwarded to Create")
+
+	// inline content ends up in a file the driver can read
+	path := strings.TrimPrefix(option, "--amazonec2-userdata=")
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, config.Machine.UserData, string(content))
+
+	// a plain file path is passed through untouched
+	config.Machine.UserData = path
+	_, errCh = p.create(config, machineStateIdle)
+	assert.NoError(t, <-errCh)
+	assert.Contains(t, tm.LastCreateOpts, "--amazonec2-userdata="+path)
+
+	// a driver without a known user-data option refuses the config
+	config.Machine.MachineDriver = "virtualbox"
+	_, err = p.machineOptions(config)
+	assert.Error(t, err)
+}
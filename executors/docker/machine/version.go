@@ -0,0 +1,71 @@
+package machine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-runner/common"
+)
+
+// binaryPathSetter is implemented by Machine backends whose executable
+// path can be overridden, e.g. to pin a specific docker-machine build
+type binaryPathSetter interface {
+	SetBinary(path string)
+}
+
+// versionReporter is implemented by Machine backends that can report the
+// version of the tooling they drive
+type versionReporter interface {
+	Version() (string, error)
+}
+
+// versionAtLeast compares two dotted version strings numerically,
+// segment by segment; missing segments count as zero
+func versionAtLeast(version, minimum string) bool {
+	current := strings.Split(version, ".")
+	wanted := strings.Split(minimum, ".")
+
+	for i := 0; i < len(current) || i < len(wanted); i++ {
+		var have, want int
+		if i < len(current) {
+			have, _ = strconv.Atoi(current[i])
+		}
+		if i < len(wanted) {
+			want, _ = strconv.Atoi(wanted[i])
+		}
+		if have != want {
+			return have > want
+		}
+	}
+	return true
+}
+
+// verifyBackend runs the one-time startup check of the machine backend:
+// it applies a configured binary override and refuses to start when the
+// binary is missing or older than the minimum supported version. The
+// result is cached, so only the first Acquire pays for it
+func (m *machineProvider) verifyBackend(config *common.RunnerConfig) error {
+	m.verifyOnce.Do(func() {
+		if config.Machine.MachineBinary != "" {
+			if machine, ok := m.machine.(binaryPathSetter); ok {
+				machine.SetBinary(config.Machine.MachineBinary)
+			}
+		}
+
+		reporter, ok := m.machine.(versionReporter)
+		if !ok {
+			return
+		}
+
+		version, err := reporter.Version()
+		if err != nil {
+			m.verifyErr = fmt.Errorf("docker-machine binary is not usable: %v", err)
+			return
+		}
+		if version != "" && !versionAtLeast(version, minMachineVersion) {
+			m.verifyErr = fmt.Errorf("docker-machine version %s is not supported, need at least %s", version, minMachineVersion)
+		}
+	})
+	return m.verifyErr
+}
@@ -0,0 +1,53 @@
+package machine
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionAtLeast(t *testing.T) {
+	assert.True(t, versionAtLeast("0.14.0", "0.14.0"))
+	assert.True(t, versionAtLeast("0.16.2", "0.14.0"))
+	assert.True(t, versionAtLeast("1.0", "0.14.0"))
+	assert.False(t, versionAtLeast("0.7.0", "0.14.0"))
+	assert.False(t, versionAtLeast("0.14", "0.14.1"))
+}
+
+func TestMachineBackendVersionCheck(t *testing.T) {
+	p, tm := testMachineProvider()
+	tm.version = "0.7.0"
+
+	config := createMachineConfig(0, 5)
+	_, err := p.Acquire(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "version 0.7.0 is not supported")
+	}
+
+	// The result is cached: a second Acquire fails the same way
+	_, err = p.Acquire(config)
+	assert.Error(t, err)
+}
+
+func TestMachineBackendVersionMissing(t *testing.T) {
+	p, tm := testMachineProvider()
+	tm.versionErr = errors.New("executable file not found in $PATH")
+
+	_, err := p.Acquire(createMachineConfig(0, 5))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "docker-machine binary is not usable")
+	}
+}
+
+func TestMachineBackendBinaryOverride(t *testing.T) {
+	p, tm := testMachineProvider()
+	tm.version = "0.16.2"
+
+	config := createMachineConfig(0, 5)
+	config.Machine.MachineBinary = "/opt/docker-machine-0.16.2"
+
+	_, err := p.Acquire(config)
+	assert.NoError(t, err, "a supported version should pass the startup check")
+	assert.Equal(t, "/opt/docker-machine-0.16.2", tm.binaryPath, "the configured binary should be applied before the version check")
+}
@@ -0,0 +1,81 @@
+package machine
+
+import "sync"
+
+// workPool caps how many background goroutines the provider runs at
+// once, across all operation kinds. It's a safety valve against
+// pathological churn: the per-operation queues bound creations and
+// removals separately, the pool bounds their goroutines combined
+type workPool struct {
+	lock    sync.Mutex
+	budget  int
+	running int
+	queue   []func()
+}
+
+// newWorkPool returns a pool running up to budget functions at once; a
+// non-positive budget means no limit
+func newWorkPool(budget int) *workPool {
+	return &workPool{budget: budget}
+}
+
+func (p *workPool) setBudget(budget int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.budget = budget
+}
+
+// submit runs fn on its own goroutine while the budget allows it and
+// queues it otherwise; a finishing goroutine drains the queue before it
+// exits
+func (p *workPool) submit(fn func()) {
+	p.lock.Lock()
+	if p.budget <= 0 || p.running < p.budget {
+		p.running++
+		p.lock.Unlock()
+		go p.run(fn)
+		return
+	}
+	p.queue = append(p.queue, fn)
+	p.lock.Unlock()
+}
+
+func (p *workPool) run(fn func()) {
+	for {
+		fn()
+
+		p.lock.Lock()
+		if len(p.queue) == 0 {
+			p.running--
+			p.lock.Unlock()
+			return
+		}
+		fn, p.queue = p.queue[0], p.queue[1:]
+		p.lock.Unlock()
+	}
+}
+
+func (p *workPool) depth() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.queue)
+}
+
+// submitWork schedules fn as provider background work, falling back to
+// a plain goroutine when no pool is set up
+func (m *machineProvider) submitWork(fn func()) {
+	if m.work == nil {
+		go fn()
+		return
+	}
+	m.work.submit(fn)
+}
+
+// workQueueDepth is how many background operations currently wait for
+// the goroutine budget
+func (m *machineProvider) workQueueDepth() int {
+	if m.work == nil {
+		return 0
+	}
+	return m.work.depth()
+}
@@ -0,0 +1,67 @@
+package machine
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkPoolBoundsGoroutines(t *testing.T) {
+	pool := newWorkPool(2)
+
+	gate := make(chan struct{})
+	started := make(chan struct{}, 20)
+	var wg sync.WaitGroup
+	var running, peak int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		pool.submit(func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+					break
+				}
+			}
+			started <- struct{}{}
+			<-gate
+			atomic.AddInt32(&running, -1)
+		})
+	}
+
+	// Both budget slots must be busy before the gate opens, otherwise
+	// the peak observation races with the drain
+	<-started
+	<-started
+
+	var depth int
+	for i := 0; i < 100; i++ {
+		depth = pool.depth()
+		if depth == 18 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 18, depth, "all work beyond the budget should queue")
+
+	close(gate)
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&peak), "no more work than the budget may run at once")
+	assert.Zero(t, pool.depth(), "the queue should drain completely")
+}
+
+func TestMachineWorkBudgetBoundsCreations(t *testing.T) {
+	p, tm := testMachineProvider()
+	p.work = newWorkPool(2)
+
+	config := createMachineConfig(10, 5)
+	p.Acquire(config)
+	assertIdleMachines(t, p, 10)
+
+	assert.True(t, tm.maxCreateConcurrency <= 2,
+		"expected at most 2 concurrent creations, saw %d", tm.maxCreateConcurrency)
+}
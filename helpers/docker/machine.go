@@ -9,6 +9,7 @@ type Machine interface {
 	Provision(name string) error
 	Remove(name string) error
 	Stop(name string, timeout time.Duration) error
+	Start(name string) error
 	List() (machines []string, err error)
 	Exist(name string) bool
 
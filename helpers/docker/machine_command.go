@@ -2,6 +2,7 @@ package docker_helpers
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -80,6 +81,77 @@ func stderrLogWriter(cmd *exec.Cmd, fields logrus.Fields) {
 type machineCommand struct {
 	cache     map[string]machineInfo
 	cacheLock sync.RWMutex
+
+	storagePath     string
+	storagePathLock sync.RWMutex
+
+	binaryPath     string
+	binaryPathLock sync.RWMutex
+}
+
+// SetBinary makes all subsequent machine operations use the given
+// docker-machine binary instead of the one found on PATH, e.g. when a
+// driver needs a specific docker-machine version
+func (m *machineCommand) SetBinary(path string) {
+	m.binaryPathLock.Lock()
+	defer m.binaryPathLock.Unlock()
+	m.binaryPath = path
+}
+
+func (m *machineCommand) binary() string {
+	m.binaryPathLock.RLock()
+	defer m.binaryPathLock.RUnlock()
+	if m.binaryPath != "" {
+		return m.binaryPath
+	}
+	return "docker-machine"
+}
+
+// Version reports the version of the docker-machine binary, e.g.
+// "0.16.2" from "docker-machine version 0.16.2, build bd45ab13"
+func (m *machineCommand) Version() (string, error) {
+	out, err := exec.Command(m.binary(), "--version").Output()
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(out))
+	for i, field := range fields {
+		if field == "version" && i+1 < len(fields) {
+			return strings.TrimSuffix(fields[i+1], ","), nil
+		}
+	}
+	return "", fmt.Errorf("unexpected docker-machine version output: %q", strings.TrimSpace(string(out)))
+}
+
+// SetStoragePath makes all subsequent machine operations use the given
+// docker-machine storage path, so that multiple runner processes on one
+// host don't clobber each other's machine store
+func (m *machineCommand) SetStoragePath(path string) {
+	m.storagePathLock.Lock()
+	defer m.storagePathLock.Unlock()
+	m.storagePath = path
+}
+
+func (m *machineCommand) getStoragePath() string {
+	m.storagePathLock.RLock()
+	defer m.storagePathLock.RUnlock()
+	return m.storagePath
+}
+
+func (m *machineCommand) env() []string {
+	env := os.Environ()
+	if path := m.getStoragePath(); path != "" {
+		env = append(env, "MACHINE_STORAGE_PATH="+path)
+	}
+	return env
+}
+
+func (m *machineCommand) machineDir() string {
+	if path := m.getStoragePath(); path != "" {
+		return filepath.Join(path, "machines")
+	}
+	return mcndirs.GetMachineDir()
 }
 
 type machineInfo struct {
@@ -98,8 +170,8 @@ func (m *machineCommand) Create(driver, name string, opts ...string) error {
 	}
 	args = append(args, name)
 
-	cmd := exec.Command("docker-machine", args...)
-	cmd.Env = os.Environ()
+	cmd := exec.Command(m.binary(), args...)
+	cmd.Env = m.env()
 
 	fields := logrus.Fields{
 		"operation": "create",
@@ -107,15 +179,29 @@ func (m *machineCommand) Create(driver, name string, opts ...string) error {
 		"name":      name,
 	}
 	stdoutLogWriter(cmd, fields)
-	stderrLogWriter(cmd, fields)
+
+	// Stream stderr to the log, but also keep a copy so that a failure
+	// can surface the driver output in the returned error
+	var stderr bytes.Buffer
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	newLogWriter(logrus.WithFields(fields).Errorln, reader)
+	cmd.Stderr = io.MultiWriter(&stderr, writer)
 
 	logrus.Debugln("Executing", cmd.Path, cmd.Args)
-	return cmd.Run()
+	err := cmd.Run()
+	if err != nil {
+		if details := strings.TrimSpace(stderr.String()); details != "" {
+			return fmt.Errorf("%v: %s", err, details)
+		}
+		return err
+	}
+	return nil
 }
 
 func (m *machineCommand) Provision(name string) error {
-	cmd := exec.Command("docker-machine", "provision", name)
-	cmd.Env = os.Environ()
+	cmd := exec.Command(m.binary(), "provision", name)
+	cmd.Env = m.env()
 
 	fields := logrus.Fields{
 		"operation": "provision",
@@ -131,8 +217,8 @@ func (m *machineCommand) Stop(name string, timeout time.Duration) error {
 	ctx, ctxCancelFn := context.WithTimeout(context.Background(), timeout)
 	defer ctxCancelFn()
 
-	cmd := exec.CommandContext(ctx, "docker-machine", "stop", name)
-	cmd.Env = os.Environ()
+	cmd := exec.CommandContext(ctx, m.binary(), "stop", name)
+	cmd.Env = m.env()
 
 	fields := logrus.Fields{
 		"operation": "stop",
@@ -144,9 +230,39 @@ func (m *machineCommand) Stop(name string, timeout time.Duration) error {
 	return cmd.Run()
 }
 
+func (m *machineCommand) Start(name string) error {
+	cmd := exec.Command(m.binary(), "start", name)
+	cmd.Env = m.env()
+
+	fields := logrus.Fields{
+		"operation": "start",
+		"name":      name,
+	}
+	stdoutLogWriter(cmd, fields)
+	stderrLogWriter(cmd, fields)
+
+	return cmd.Run()
+}
+
+// Regenerate rebuilds the machine's TLS certificates in place, for
+// machines whose certs expired while they sat in the pool
+func (m *machineCommand) Regenerate(name string) error {
+	cmd := exec.Command(m.binary(), "regenerate-certs", "-f", name)
+	cmd.Env = m.env()
+
+	fields := logrus.Fields{
+		"operation": "regenerate-certs",
+		"name":      name,
+	}
+	stdoutLogWriter(cmd, fields)
+	stderrLogWriter(cmd, fields)
+
+	return cmd.Run()
+}
+
 func (m *machineCommand) Remove(name string) error {
-	cmd := exec.Command("docker-machine", "rm", "-y", name)
-	cmd.Env = os.Environ()
+	cmd := exec.Command(m.binary(), "rm", "-y", name)
+	cmd.Env = m.env()
 
 	fields := logrus.Fields{
 		"operation": "remove",
@@ -166,7 +282,7 @@ func (m *machineCommand) Remove(name string) error {
 }
 
 func (m *machineCommand) List() (hostNames []string, err error) {
-	dir, err := ioutil.ReadDir(mcndirs.GetMachineDir())
+	dir, err := ioutil.ReadDir(m.machineDir())
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
@@ -185,8 +301,8 @@ func (m *machineCommand) List() (hostNames []string, err error) {
 
 func (m *machineCommand) get(args ...string) (out string, err error) {
 	// Execute docker-machine to fetch IP
-	cmd := exec.Command("docker-machine", args...)
-	cmd.Env = os.Environ()
+	cmd := exec.Command(m.binary(), args...)
+	cmd.Env = m.env()
 	data, err := cmd.Output()
 	if err != nil {
 		return
@@ -212,19 +328,25 @@ func (m *machineCommand) CertPath(name string) (string, error) {
 	return m.get("inspect", name, "-f", "{{.HostOptions.AuthOptions.StorePath}}")
 }
 
+// DriverName reports the docker-machine driver the machine was created
+// with, e.g. "google" or "amazonec2"
+func (m *machineCommand) DriverName(name string) (string, error) {
+	return m.get("inspect", name, "-f", "{{.DriverName}}")
+}
+
 func (m *machineCommand) Status(name string) (string, error) {
 	return m.get("status", name)
 }
 
 func (m *machineCommand) Exist(name string) bool {
-	configPath := filepath.Join(mcndirs.GetMachineDir(), name, "config.json")
+	configPath := filepath.Join(m.machineDir(), name, "config.json")
 	_, err := os.Stat(configPath)
 	if err != nil {
 		return false
 	}
 
-	cmd := exec.Command("docker-machine", "inspect", name)
-	cmd.Env = os.Environ()
+	cmd := exec.Command(m.binary(), "inspect", name)
+	cmd.Env = m.env()
 
 	fields := logrus.Fields{
 		"operation": "exists",
@@ -260,8 +382,8 @@ func (m *machineCommand) CanConnect(name string, skipCache bool) bool {
 
 func (m *machineCommand) canConnect(name string) bool {
 	// Execute docker-machine config which actively ask the machine if it is up and online
-	cmd := exec.Command("docker-machine", "config", name)
-	cmd.Env = os.Environ()
+	cmd := exec.Command(m.binary(), "config", name)
+	cmd.Env = m.env()
 	err := cmd.Run()
 	if err == nil {
 		return true
@@ -54,6 +54,22 @@ func TestList(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	guardMachineOperationTest(t, "custom storage path", func(t *testing.T) {
+		storagePath, err := ioutil.TempDir("", "docker-machine-storage")
+		require.NoError(t, err)
+		defer os.RemoveAll(storagePath)
+
+		err = os.MkdirAll(path.Join(storagePath, "machines", "machine-2"), 0755)
+		require.NoError(t, err)
+
+		mc := NewMachineCommand()
+		mc.(*machineCommand).SetStoragePath(storagePath)
+		hostNames, err := mc.List()
+		assert.Contains(t, hostNames, "machine-2")
+		assert.Len(t, hostNames, 1)
+		assert.NoError(t, err)
+	})
+
 	guardMachineOperationTest(t, "machines directory doesn't exists", func(t *testing.T) {
 		mc := NewMachineCommand()
 		hostNames, err := mc.List()
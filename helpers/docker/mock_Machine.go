@@ -133,6 +133,20 @@ func (_m *MockMachine) Remove(name string) error {
 	return r0
 }
 
+// Start provides a mock function with given fields: name
+func (_m *MockMachine) Start(name string) error {
+	ret := _m.Called(name)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(name)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Stop provides a mock function with given fields: name, timeout
 func (_m *MockMachine) Stop(name string, timeout time.Duration) error {
 	ret := _m.Called(name, timeout)